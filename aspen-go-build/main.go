@@ -33,8 +33,9 @@ var (
 
 By default, aspen-build will build simplates found in the "www root" (-w)
 into Go sources written to generated package (-p) in the output GOPATH base
-(-o), optionally running 'go fmt' (-F).  The output GOPATH base must already
-exist, or the '-m' flag may be passed to ensure it exists.
+(-o), optionally formatting them (-F).  The output GOPATH base must already
+exist, or the '-m' flag may be passed to ensure it exists.  With the '-M'
+flag, the output path is instead the root of a generated Go module.
 `
 	usageInfo    = ""
 	changeEvents = inotify.IN_CREATE | inotify.IN_DELETE |
@@ -86,6 +87,7 @@ func main() {
 
 	compile := true
 	format := true
+	typeCheck := true
 	genPkg := aspen.DefaultGenPackage
 	mkOutDir := false
 	outPath := aspen.DefaultOutputGopath
@@ -95,6 +97,15 @@ func main() {
 	genServerBind := ":9182"
 	listDirs := false
 	runServer := false
+	staticPaths := ""
+	jobs := aspen.DefaultJobs
+	moduleMode := false
+	modulePath := ""
+	aspenReplace := ""
+	aspenImportPath := aspen.DefaultAspenImportPath
+	serverBinary := ""
+	embedStatic := false
+	libDir := aspen.DefaultLibDir
 
 	charsetDynamic := aspen.DefaultCharsetDynamic
 	charsetStatic := aspen.DefaultCharsetStatic
@@ -119,7 +130,26 @@ func main() {
 	optarg.Add("F", "format", "Format generated sources", "")
 	optarg.Add("m", "make_outdir",
 		"Make output GOPATH base if not exists", mkOutDir)
+	optarg.Add("T", "type_check", "Type-check generated sources, "+
+		"even when not compiling", typeCheck)
 	optarg.Add("C", "compile", "Compile generated sources", "")
+	optarg.Add("j", "jobs", "Number of simplates to parse and generate at once", jobs)
+	optarg.Add("M", "module", "Write generated sources as a Go module rooted "+
+		"at the output path, rather than into a GOPATH base", moduleMode)
+	optarg.Add("", "module_path", "Module path of the generated module "+
+		"(defaults to the package name)", modulePath)
+	optarg.Add("", "aspen_replace", "Directory of a local aspen-go checkout "+
+		"to use in the generated module", aspenReplace)
+	optarg.Add("", "aspen_import_path", "Import path of aspen-go, e.g. of "+
+		"a fork, in generated sources", aspenImportPath)
+	optarg.Add("", "server_binary", "Path of the compiled server binary "+
+		"(defaults to bin/<package_name>-http-server in the output path)", serverBinary)
+	optarg.Add("E", "embed_static", "Embed static files in the compiled "+
+		"server, so that it can be run without the www root", embedStatic)
+	optarg.Add("", "lib_dir", "Directory of the www root whose Go sources "+
+		"are shared by all simplates, and which is never served", libDir)
+	optarg.Add("", "static_paths", "Comma-separated glob patterns of "+
+		"www root paths that are always static, never simplates", staticPaths)
 	optarg.Add("", "changes_reload", "Changes reload.  If set to true/1, "+
 		"changes to configuration files and document root files will cause "+
 		"simplates to rebuild, then re-exec the generated server binary "+
@@ -152,8 +182,28 @@ func main() {
 			value := opt.Bool()
 			runServer = value
 			compile = value
+		case "type_check":
+			typeCheck = opt.Bool()
 		case "compile":
 			compile = opt.Bool()
+		case "jobs":
+			jobs = opt.Int()
+		case "module":
+			moduleMode = opt.Bool()
+		case "module_path":
+			modulePath = opt.String()
+		case "aspen_replace":
+			aspenReplace = opt.String()
+		case "aspen_import_path":
+			aspenImportPath = opt.String()
+		case "server_binary":
+			serverBinary = opt.String()
+		case "embed_static":
+			embedStatic = opt.Bool()
+		case "lib_dir":
+			libDir = opt.String()
+		case "static_paths":
+			staticPaths = opt.String()
 		case "charset_dynamic":
 			charsetDynamic = opt.String()
 		case "charset_static":
@@ -182,15 +232,37 @@ func main() {
 		indicesArray = append(indicesArray, strings.TrimSpace(part))
 	}
 
+	if len(serverBinary) == 0 {
+		serverBinary = aspen.DefaultServerBinary(outPath, genPkg)
+	}
+
+	staticPathsArray := []string{}
+	for _, part := range strings.Split(staticPaths, ",") {
+		part = strings.TrimSpace(part)
+		if len(part) > 0 {
+			staticPathsArray = append(staticPathsArray, part)
+		}
+	}
+
 	for {
 		retcode = aspen.BuildMain(&aspen.SiteBuilderCfg{
-			WwwRoot:       wwwRoot,
-			OutputGopath:  outPath,
-			GenPackage:    genPkg,
-			GenServerBind: genServerBind,
-			Format:        format,
-			MkOutDir:      mkOutDir,
-			Compile:       compile,
+			WwwRoot:         wwwRoot,
+			OutputGopath:    outPath,
+			GenPackage:      genPkg,
+			GenServerBind:   genServerBind,
+			Format:          format,
+			MkOutDir:        mkOutDir,
+			TypeCheck:       typeCheck,
+			Compile:         compile,
+			StaticPaths:     staticPathsArray,
+			Jobs:            jobs,
+			ModuleMode:      moduleMode,
+			ModulePath:      modulePath,
+			AspenReplace:    aspenReplace,
+			AspenImportPath: aspenImportPath,
+			ServerBinary:    serverBinary,
+			EmbedStatic:     embedStatic,
+			LibDir:          libDir,
 
 			CharsetDynamic: charsetDynamic,
 			CharsetStatic:  charsetStatic,
@@ -207,8 +279,7 @@ func main() {
 		quitChan := make(chan bool)
 
 		go func(ret chan int, q chan bool) {
-			httpExe := path.Join(outPath, "bin", genPkg+"-http-server")
-			srvCmd := exec.Command(httpExe,
+			srvCmd := exec.Command(serverBinary,
 				"-w", wwwRoot, "-a", genServerBind, "-x", fmt.Sprintf("%v", debug))
 			srvCmd.Stdout = os.Stdout
 			srvCmd.Stderr = os.Stderr
@@ -1,9 +1,13 @@
 package aspen
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
+	"compress/gzip"
 	"crypto/sha1"
 	"fmt"
+	"go/ast"
 	"go/parser"
 	"go/token"
 	"io"
@@ -11,12 +15,18 @@ import (
 	"log"
 	"math/rand"
 	"mime"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
 	"testing"
+	"testing/fstest"
+	"text/template"
 	"time"
 )
 
@@ -37,6 +47,31 @@ ctx["D"] = &RDance{
 }
 
 {{.D.Who}} Dance {{.D.When}}!
+`
+	basicRenderedHtmlSimplate = `
+import (
+    "time"
+)
+
+type HDance struct {
+    Who  string
+    When time.Time
+}
+
+ctx["D"] = &HDance{
+    Who:  "<b>Everybody</b>",
+    When: time.Now(),
+}
+
+<p>{{.D.Who}} Dance {{.D.When}}!</p>
+`
+	basicMarkdownSimplate = `
+
+ctx["Who"] = "Everybody"
+ #!markdown
+# {{.Who}} Dance Now!
+
+Dance *all* the dances.
 `
 	basicStaticTxtSimplate = `
 Everybody Dance Now!
@@ -89,6 +124,8 @@ var (
 	testSiteFiles = map[string]string{
 		"hams/bone/derp":                               basicNegotiatedSimplate,
 		"shill/cans.txt":                               basicRenderedTxtSimplate,
+		"shill/dance.html":                             basicRenderedHtmlSimplate,
+		"shill/about.html":                             basicMarkdownSimplate,
 		"hat/v.json":                                   basicJsonSimplate,
 		"silmarillion.handlebar.mustache.moniker.html": "<html>INVALID AS BUTT</html>",
 		"Big CMS/Owns_UR Contents/flurb.txt":           basicStaticTxtSimplate,
@@ -163,6 +200,30 @@ func mkTestSite() string {
 	return testWwwRoot
 }
 
+// mkLargeTestSite adds n copies of each test simplate to the test site, in
+// nested directories, as a stand-in for a large docroot.
+func mkLargeTestSite(n int) string {
+	siteRoot := mkTestSite()
+
+	for i := 0; i < n; i++ {
+		for filePath, content := range testSiteFiles {
+			fullPath := path.Join(siteRoot, "large", fmt.Sprintf("%03d", i%100),
+				fmt.Sprintf("%d", i), filePath)
+			err := os.MkdirAll(path.Dir(fullPath), os.ModeDir|os.ModePerm)
+			if err != nil {
+				panic(err)
+			}
+
+			err = ioutil.WriteFile(fullPath, []byte(content), 0644)
+			if err != nil {
+				panic(err)
+			}
+		}
+	}
+
+	return siteRoot
+}
+
 func writeRenderedTemplate() (string, error) {
 	s, err := newSimplateFromString("aspen_go_gen", "/tmp", "/tmp/basic-rendered.txt", basicRenderedTxtSimplate)
 	if err != nil {
@@ -257,11 +318,138 @@ func TestRenderedSimplateKnowsItsOutputName(t *testing.T) {
 		return
 	}
 
-	if s.OutputName() != "flip-SLASH-dippy-SPACE-slippy-SLASH-PCT-zonk-SLASH-snork-DOT-d-SLASH-basic-rendered-DOT-txt.go" {
+	if s.OutputName() != "flip-SLASH-dippy-SPACE-slippy-SLASH--PCT-zonk-SLASH-snork-DOT-d-SLASH-basic-DASH-rendered-DOT-txt.go" {
 		t.Errorf("Rendered simplate output name is wrong!: %v", s.OutputName())
 	}
 }
 
+func TestSimplateNamesMatchGoldenFile(t *testing.T) {
+	filenames := []string{
+		"shill/cans.txt",
+		"a.b.txt",
+		"a-DOT-b.txt",
+		"a-b.txt",
+		"a_b.txt",
+		"a--b.txt",
+		"-x.txt",
+		"_x.txt",
+		"1up.txt",
+		"Abc.txt",
+		"abc.txt",
+		"x_windows",
+		"a+b.txt",
+		"%name/index.html",
+		"Big CMS/Owns_UR Contents/flurb.txt",
+		"ünïcode.html",
+	}
+
+	var buf bytes.Buffer
+	outputs := map[string]string{}
+	funcNames := map[string]string{}
+
+	for _, filename := range filenames {
+		s := &simplate{Filename: filename, Type: SimplateTypeRendered}
+
+		fmt.Fprintf(&buf, "%s\t%s\t%s\t%s\n", filename, s.OutputName(),
+			s.FuncName(), s.ConstName())
+
+		for _, ident := range []string{s.FuncName(), s.ConstName(),
+			"SimplateHandlerFunc" + s.FuncName()} {
+			if !token.IsIdentifier(ident) {
+				t.Errorf("%q yields invalid identifier %q", filename, ident)
+			}
+		}
+
+		if other, ok := outputs[s.OutputName()]; ok {
+			t.Errorf("%q and %q share output name %q", filename, other, s.OutputName())
+		}
+
+		if other, ok := funcNames[s.FuncName()]; ok {
+			t.Errorf("%q and %q share func name %q", filename, other, s.FuncName())
+		}
+
+		outputs[s.OutputName()] = filename
+		funcNames[s.FuncName()] = filename
+	}
+
+	golden := path.Join("testdata", "simplate-names.golden")
+	if len(os.Getenv("ASPEN_GO_TEST_UPDATE_GOLDEN")) > 0 {
+		err := ioutil.WriteFile(golden, buf.Bytes(), 0644)
+		if err != nil {
+			t.Error(err)
+		}
+		return
+	}
+
+	expected, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Errorf("Simplate names differ from %s:\n%s", golden, buf.String())
+	}
+}
+
+func TestSiteBuilderWarnsOfSourcesDifferingInCase(t *testing.T) {
+	mkTestSite()
+	if noCleanup {
+		fmt.Println("tmpdir =", tmpdir)
+	} else {
+		defer rmTmpDir()
+	}
+
+	for _, filePath := range []string{"shill/Cans.txt", "shill/CANS.txt"} {
+		err := ioutil.WriteFile(path.Join(testWwwRoot, filePath),
+			[]byte(basicRenderedTxtSimplate), 0644)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	sb, err := newSiteBuilder(&SiteBuilderCfg{
+		WwwRoot:       testWwwRoot,
+		OutputGopath:  tmpdir,
+		GenServerBind: ":9182",
+		MkOutDir:      true,
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// such sources are distinct on case-sensitive file systems
+	err = sb.Build()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	simplates, err := sb.walker.Simplates()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	errs, warnings := checkOutputNames(simplates)
+	if len(errs) != 0 {
+		t.Errorf("Expected no collisions, got %v", errs)
+	}
+
+	if len(warnings) != 2 {
+		t.Errorf("Expected 2 warnings, got %v", warnings)
+	}
+
+	for _, warning := range warnings {
+		serr, ok := warning.(*SimplateError)
+		if !ok || serr.Code != SimplateErrorNameCollision {
+			t.Errorf("Expected a name collision warning, got %#v", warning)
+		}
+	}
+}
+
 func TestDetectsRenderedSimplate(t *testing.T) {
 	s, err := newSimplateFromString("aspen_go_gen", "/tmp", "/tmp/basic-rendered.txt", basicRenderedTxtSimplate)
 	if err != nil {
@@ -363,6 +551,150 @@ func TestAssignsOneTemplatePageToRenderedSimplates(t *testing.T) {
 	}
 }
 
+func TestTwoPageRenderedSimplateHasLogicAndTemplatePages(t *testing.T) {
+	s, err := newSimplateFromString("aspen_go_gen", "/tmp", "/tmp/two-pages.txt",
+		"ctx[\"Who\"] = \"Everybody\"\n\x0c\n{{.Who}} Dance!\n")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if s.Type != SimplateTypeRendered {
+		t.Errorf("Simplate detected as %s instead of %s", s.Type, SimplateTypeRendered)
+	}
+
+	if s.InitPage == nil || len(s.InitPage.Body) > 0 {
+		t.Errorf("Two-page simplate has unexpected init page: %+v", s.InitPage)
+	}
+
+	if s.LogicPage == nil || !strings.Contains(s.LogicPage.Body, "ctx[") {
+		t.Errorf("Two-page simplate has unexpected logic page: %+v", s.LogicPage)
+	}
+
+	if len(s.TemplatePages) != 1 || s.TemplatePages[0].Body != "{{.Who}} Dance!\n" {
+		t.Errorf("Two-page simplate has unexpected template pages: %+v", s.TemplatePages)
+	}
+
+	var out bytes.Buffer
+	err = s.Execute(&out)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	fset := token.NewFileSet()
+	_, err = parser.ParseFile(fset, "two-pages.go", out.Bytes(), parser.DeclarationErrors)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSingleVariantNegotiatedSimplates(t *testing.T) {
+	for _, content := range []string{
+		"ctx[\"Who\"] = \"Everybody\"\n\x0c text/plain\n{{.Who}} Dance!\n",
+		"\n\x0cctx[\"Who\"] = \"Everybody\"\n\x0c text/plain\n{{.Who}} Dance!\n",
+	} {
+		s, err := newSimplateFromString("aspen_go_gen", "/tmp", "/tmp/hork", content)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		if s.Type != SimplateTypeNegotiated {
+			t.Errorf("Simplate detected as %s instead of %s", s.Type, SimplateTypeNegotiated)
+		}
+
+		if len(s.TemplatePages) != 1 || s.TemplatePages[0].Spec.ContentType != "text/plain" {
+			t.Errorf("Single variant negotiated simplate has unexpected "+
+				"template pages: %+v", s.TemplatePages)
+		}
+	}
+}
+
+func TestNegotiatedSimplateVariantsRequireSpecline(t *testing.T) {
+	_, err := newSimplateFromString("aspen_go_gen", "/tmp", "/tmp/hork",
+		"ctx[\"Who\"] = \"Everybody\"\n\x0c\n{{.Who}} Dance!\n")
+	if serr, ok := err.(*SimplateError); !ok || serr.Code != SimplateErrorInvalidSpecline {
+		t.Errorf("Negotiated variant without specline was not rejected: %v", err)
+	}
+}
+
+func TestThreePageJSONSimplateIsRendered(t *testing.T) {
+	s, err := newSimplateFromString("aspen_go_gen", "/tmp", "/tmp/three.json",
+		"\n\x0c\nctx[\"Who\"] = \"Everybody\"\n\x0c\n{\"who\":\"{{.Who}}\"}\n")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if s.Type != SimplateTypeRendered || len(s.TemplatePages) != 1 {
+		t.Errorf("Three-page JSON simplate detected as %s with %d template pages",
+			s.Type, len(s.TemplatePages))
+	}
+}
+
+func TestDashPageBreaksSplitPages(t *testing.T) {
+	content := strings.Replace(basicNegotiatedSimplate, "\x0c", "[---]", -1)
+
+	s, err := newSimplateFromString("aspen_go_gen", "/tmp", "/tmp/hork", content)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if s.Type != SimplateTypeNegotiated || len(s.TemplatePages) != 2 {
+		t.Errorf("Simplate detected as %s with %d template pages", s.Type, len(s.TemplatePages))
+		return
+	}
+
+	for i, expected := range []string{"text/plain", "application/json"} {
+		if s.TemplatePages[i].Spec.ContentType != expected {
+			t.Errorf("Template page %d content type is %q instead of %q", i,
+				s.TemplatePages[i].Spec.ContentType, expected)
+		}
+	}
+
+	if s.LogicPage.Line != 10 || s.TemplatePages[1].Line != 19 {
+		t.Errorf("Pages begin on unexpected lines: logic=%d, json=%d",
+			s.LogicPage.Line, s.TemplatePages[1].Line)
+	}
+
+	if strings.Contains(s.LogicPage.Body, "[---]") {
+		t.Errorf("Page break left in logic page: %q", s.LogicPage.Body)
+	}
+}
+
+func TestDashPageBreaksAcceptSpeclines(t *testing.T) {
+	content := strings.Replace(basicRenderedHtmlSimplate, "\x0c", "[---]", -1)
+	content = strings.Replace(content, "[---]\n<p>", "[---] #!go/text/template\n<p>", 1)
+
+	s, err := newSimplateFromString("aspen_go_gen", "/tmp", "/tmp/basic-rendered.html", content)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if s.FirstTemplatePage().Spec.Renderer != defaultRenderer {
+		t.Errorf("Template page renderer is %q instead of %q",
+			s.FirstTemplatePage().Spec.Renderer, defaultRenderer)
+	}
+}
+
+func TestMixedPageBreaksAreAnError(t *testing.T) {
+	content := strings.Replace(basicNegotiatedSimplate, "\x0c text/plain", "[---] text/plain", 1)
+
+	_, err := newSimplateFromString("aspen_go_gen", "/tmp", "/tmp/hork", content)
+	serr, ok := err.(*SimplateError)
+	if !ok {
+		t.Errorf("Expected a *SimplateError, got %#v", err)
+		return
+	}
+
+	if serr.Code != SimplateErrorMixedPageBreaks || serr.Line != 15 {
+		t.Errorf("Mixed page break error has unexpected location or code: %+v", serr)
+	}
+}
+
 func TestAssignsAnInitPageToJSONSimplates(t *testing.T) {
 	s, err := newSimplateFromString("aspen_go_gen", "/tmp", "/tmp/basic.json", basicJsonSimplate)
 	if err != nil {
@@ -437,144 +769,342 @@ func TestRenderedSimplateCanExecuteToWriter(t *testing.T) {
 	}
 }
 
-func TestRenderedSimplateOutputIsValidGoSource(t *testing.T) {
-	mkTmpDir()
-	if noCleanup {
-		fmt.Println("tmpdir =", tmpdir)
-	} else {
-		defer rmTmpDir()
+func TestRenderedHTMLSimplateDefaultsToHTMLTemplate(t *testing.T) {
+	s, err := newSimplateFromString("aspen_go_gen", "/tmp", "/tmp/basic-rendered.html", basicRenderedHtmlSimplate)
+	if err != nil {
+		t.Error(err)
+		return
 	}
 
-	outfileName, err := writeRenderedTemplate()
+	if s.FirstTemplatePage().Spec.Renderer != htmlRenderer {
+		t.Errorf("HTML template page renderer is %q instead of %q",
+			s.FirstTemplatePage().Spec.Renderer, htmlRenderer)
+		return
+	}
+
+	var out bytes.Buffer
+	err = s.Execute(&out)
 	if err != nil {
 		t.Error(err)
 		return
 	}
 
-	fset := token.NewFileSet()
-	_, err = parser.ParseFile(fset, outfileName, nil, parser.DeclarationErrors)
+	if !strings.Contains(out.String(), "htmltemplate.Must(") {
+		t.Errorf("Generated source does not use html/template:\n%s", out.String())
+	}
+
+	if strings.Contains(out.String(), "\"text/template\"") {
+		t.Errorf("Generated source imports unused text/template:\n%s", out.String())
+	}
+}
+
+func TestRenderedHTMLSimplateCanOptOutOfHTMLTemplate(t *testing.T) {
+	content := strings.Replace(basicRenderedHtmlSimplate,
+		"\x0c\n<p>", "\x0c #!go/text/template\n<p>", 1)
+
+	s, err := newSimplateFromString("aspen_go_gen", "/tmp", "/tmp/basic-rendered.html", content)
 	if err != nil {
 		t.Error(err)
 		return
 	}
-}
 
-func TestRenderedSimplateCanBeCompiled(t *testing.T) {
-	mkTmpDir()
-	if noCleanup {
-		fmt.Println("tmpdir =", tmpdir)
-	} else {
-		defer rmTmpDir()
+	if s.FirstTemplatePage().Spec.Renderer != defaultRenderer {
+		t.Errorf("HTML template page renderer is %q instead of %q",
+			s.FirstTemplatePage().Spec.Renderer, defaultRenderer)
 	}
+}
 
-	_, err := writeRenderedTemplate()
+func TestNegotiatedSimplateUsesHTMLTemplateForHTMLPages(t *testing.T) {
+	content := basicNegotiatedSimplate +
+		"\x0c application/xhtml+xml\n<p>{{.D.Who}}</p>\n" +
+		"\x0c text/html\n<p>{{.D.Who}}</p>\n"
+
+	s, err := newSimplateFromString("aspen_go_gen", "/tmp", "/tmp/basic-negotiated", content)
 	if err != nil {
 		t.Error(err)
 		return
 	}
 
-	err = formatAspenGoGen()
+	expected := map[string]string{
+		"text/plain":            defaultRenderer,
+		"application/json":      defaultRenderer,
+		"application/xhtml+xml": htmlRenderer,
+		"text/html":             htmlRenderer,
+	}
+
+	for _, page := range s.TemplatePages {
+		if page.Spec.Renderer != expected[page.Spec.ContentType] {
+			t.Errorf("Renderer for %q is %q instead of %q", page.Spec.ContentType,
+				page.Spec.Renderer, expected[page.Spec.ContentType])
+		}
+	}
+
+	var out bytes.Buffer
+	err = s.Execute(&out)
 	if err != nil {
 		t.Error(err)
 		return
 	}
 
-	err = buildAspenGoGen()
+	fset := token.NewFileSet()
+	_, err = parser.ParseFile(fset, "basic-negotiated.go", out.Bytes(), parser.DeclarationErrors)
 	if err != nil {
 		t.Error(err)
-		return
 	}
 }
 
-func TestTreeWalkerRequiresNonEmptyPackageName(t *testing.T) {
-	_, err := newTreeWalker("", os.TempDir())
+type testRenderer struct{}
+
+func (me *testRenderer) Imports() []string {
+	return []string{`testtemplate "text/template"`}
+}
+
+func (me *testRenderer) Compile(name, body string) string {
+	return fmt.Sprintf("testtemplate.Must(testtemplate.New(%s).Parse(%s))", name, body)
+}
+
+func (me *testRenderer) Validate(name, body string) error {
+	return nil
+}
+
+func TestRegisterRendererRejectsDuplicates(t *testing.T) {
+	err := RegisterRenderer("#!"+RendererGoTextTemplate, &testRenderer{})
 	if err == nil {
-		t.Errorf("New tree walker failed to reject empty package")
-		return
+		t.Errorf("Registering a duplicate renderer did not fail!")
 	}
 }
 
-func TestTreeWalkerRequiresValidDirectoryRoot(t *testing.T) {
-	_, err := newTreeWalker("aspen_go_gen", path.Join(tmpdir, "dev/null"))
+func TestUnknownRendererIsAnError(t *testing.T) {
+	content := strings.Replace(basicRenderedTxtSimplate,
+		"\x0c\n{{", "\x0c #!no/such/renderer\n{{", 1)
+
+	_, err := newSimplateFromString("aspen_go_gen", "/tmp", "/tmp/basic-rendered.txt", content)
 	if err == nil {
-		t.Errorf("New tree walker failed to reject invalid dir!")
+		t.Errorf("Simplate with unknown renderer was accepted!")
 		return
 	}
-}
 
-func TestTreeWalkerYieldsSimplates(t *testing.T) {
-	siteRoot := mkTestSite()
-	if noCleanup {
-		fmt.Println("tmpdir =", tmpdir)
-	} else {
-		defer rmTmpDir()
+	if !strings.Contains(err.Error(), "no/such/renderer") {
+		t.Errorf("Unknown renderer error does not name the renderer: %v", err)
 	}
+}
 
-	tw, err := newTreeWalker("aspen_go_gen", siteRoot)
+func TestRegisteredRendererIsUsedInGeneratedSource(t *testing.T) {
+	err := RegisterRenderer("test/renderer", &testRenderer{})
 	if err != nil {
 		t.Error(err)
 		return
 	}
 
-	n := 0
+	content := strings.Replace(basicRenderedTxtSimplate,
+		"\x0c\n{{", "\x0c #!test/renderer\n{{", 1)
 
-	simplates, err := tw.Simplates()
+	s, err := newSimplateFromString("aspen_go_gen", "/tmp", "/tmp/basic-rendered.txt", content)
 	if err != nil {
 		t.Error(err)
+		return
 	}
 
-	for simplate := range simplates {
-		if sort.SearchStrings(SimplateTypes, simplate.Type) < 0 {
-			t.Errorf("Simplate yielded with invalid type: %v", simplate.Type)
-			return
+	var out bytes.Buffer
+	err = s.Execute(&out)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, expected := range []string{`testtemplate "text/template"`, "testtemplate.Must("} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Generated source does not contain %q:\n%s", expected, out.String())
 		}
-		n++
 	}
 
-	if n != 5 {
-		t.Errorf("Tree walking yielded unexpected number of files: %v", n)
+	fset := token.NewFileSet()
+	_, err = parser.ParseFile(fset, "basic-rendered.go", out.Bytes(), parser.DeclarationErrors)
+	if err != nil {
+		t.Error(err)
 	}
 }
 
-func TestNewSiteBuilderRequiresValidWwwRoot(t *testing.T) {
-	_, err := newSiteBuilder(&SiteBuilderCfg{
-		WwwRoot:       path.Join(tmpdir, "dev/null"),
-		OutputGopath:  ".",
-		GenServerBind: ":9182",
-	})
-	if err == nil {
-		t.Errorf("New site builder failed to reject invalid root dir!")
+func TestMarkdownSimplateProducesHTML(t *testing.T) {
+	s, err := newSimplateFromString("aspen_go_gen", "/tmp", "/tmp/about.md", basicMarkdownSimplate)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if s.FirstTemplatePage().Spec.ContentType != "text/html" {
+		t.Errorf("Markdown template page content type is %q instead of %q",
+			s.FirstTemplatePage().Spec.ContentType, "text/html")
+	}
+
+	var out bytes.Buffer
+	err = s.Execute(&out)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !strings.Contains(out.String(), "aspen.NewMarkdownTemplate(") {
+		t.Errorf("Generated source does not use markdown template:\n%s", out.String())
+	}
+
+	fset := token.NewFileSet()
+	_, err = parser.ParseFile(fset, "about.go", out.Bytes(), parser.DeclarationErrors)
+	if err != nil {
+		t.Error(err)
 	}
 }
 
-func TestNewSiteBuilderRequiresValidOutputDir(t *testing.T) {
-	_, err := newSiteBuilder(&SiteBuilderCfg{
-		WwwRoot:       ".",
-		OutputGopath:  path.Join(tmpdir, "dev/null"),
-		GenServerBind: ":9182",
+func TestMarkdownTemplateConvertsToHTML(t *testing.T) {
+	tmpl := NewMarkdownTemplate(template.Must(template.New("md").Parse(
+		"# {{.Who}} Dance\n\nDance *all* the {{.What}}.\n")))
+
+	var out bytes.Buffer
+	err := tmpl.Execute(&out, map[string]interface{}{
+		"Who":  "Everybody",
+		"What": "<script>dances</script>",
 	})
-	if err == nil {
-		t.Errorf("New site builder failed to reject invalid output dir!")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, expected := range []string{"<h1>Everybody Dance</h1>", "<em>all</em>"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Markdown output does not contain %q: %s", expected, out.String())
+		}
+	}
+
+	if strings.Contains(out.String(), "<script>") {
+		t.Errorf("Markdown output contains raw HTML: %s", out.String())
 	}
 }
 
-func TestNewSiteBuilderDefaultsGeneratedCodePackage(t *testing.T) {
-	sb, err := newSiteBuilder(&SiteBuilderCfg{
-		WwwRoot:       ".",
-		OutputGopath:  ".",
-		GenServerBind: ":9182",
-	})
+func TestNegotiatedSimplateSupportsMarkdownVariant(t *testing.T) {
+	content := basicNegotiatedSimplate + "\x0c text/html #!markdown\n# {{.D.Who}} Dance\n"
 
+	s, err := newSimplateFromString("aspen_go_gen", "/tmp", "/tmp/basic-negotiated", content)
 	if err != nil {
 		t.Error(err)
+		return
 	}
 
-	if sb.GenPackage != "aspen_go_gen" {
-		t.Errorf("Generated package default != \"aspen_go_gen\": %q", sb.GenPackage)
+	page := s.TemplatePages[len(s.TemplatePages)-1]
+	if page.Spec.ContentType != "text/html" || page.Spec.Renderer != RendererMarkdown {
+		t.Errorf("Markdown variant has unexpected spec: %+v", page.Spec)
+	}
+
+	if s.TemplatePages[0].Spec.Renderer != defaultRenderer {
+		t.Errorf("Plain text variant has unexpected spec: %+v", s.TemplatePages[0].Spec)
 	}
 }
 
-func TestSiteBuilderExposesWwwRoot(t *testing.T) {
+func TestTemplateBodiesSurviveCodeGeneration(t *testing.T) {
+	bodies := []string{
+		"var greeting = `Hello, ${who}!`;\n",
+		"Use `go build` to {{`build`}} things\n",
+		"NUL \x00 bytes\n",
+		"invalid \xff\xfe UTF-8\n",
+		"windows\r\nline endings\r\n",
+		"\ufeffbyte order mark\n",
+		"looks like\n//line basic-rendered-DOT-txt.go:1\n",
+		"backslashes \\ and \"quotes\"\n",
+		"",
+	}
+
+	for _, body := range bodies {
+		content := "\x0c\nctx[\"who\"] = \"Everybody\"\n\x0c\n" + body
+
+		s, err := newSimplateFromString("aspen_go_gen", "/tmp", "/tmp/basic-rendered.txt", content)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		var out bytes.Buffer
+		err = s.Execute(&out)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		fset := token.NewFileSet()
+		f, err := parser.ParseFile(fset, "basic-rendered.go", out.Bytes(), parser.DeclarationErrors)
+		if err != nil {
+			t.Errorf("Template body %q produced invalid Go source: %v", body, err)
+			continue
+		}
+
+		var parsed *ast.BasicLit
+		ast.Inspect(f, func(node ast.Node) bool {
+			if call, ok := node.(*ast.CallExpr); ok {
+				if sel, ok := call.Fun.(*ast.SelectorExpr); ok && sel.Sel.Name == "Parse" {
+					parsed, _ = call.Args[0].(*ast.BasicLit)
+				}
+			}
+			return true
+		})
+
+		if parsed == nil {
+			t.Errorf("No template body literal found for %q", body)
+			continue
+		}
+
+		roundTripped, err := strconv.Unquote(parsed.Value)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		if roundTripped != body {
+			t.Errorf("Template body %q round-tripped as %q", body, roundTripped)
+		}
+	}
+}
+
+func TestBrokenTemplatesAreReportedWithSimplateLine(t *testing.T) {
+	content := strings.Replace(basicRenderedTxtSimplate,
+		"{{.D.Who}} Dance", "Ready?\n{{.D.Who Dance", 1)
+
+	s, err := newSimplateFromString("aspen_go_gen", "/tmp", "/tmp/basic-rendered.txt", content)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	errs, ok := s.ValidateTemplates().(MultiError)
+	if !ok || len(errs) != 1 {
+		t.Errorf("Broken template was not reported: %v", s.ValidateTemplates())
+		return
+	}
+
+	serr, ok := errs[0].(*SimplateError)
+	if !ok {
+		t.Errorf("Expected a *SimplateError, got %#v", errs[0])
+		return
+	}
+
+	if serr.Code != SimplateErrorInvalidTemplate || serr.Page != 2 || serr.Line != 17 {
+		t.Errorf("Template error has unexpected location or code: %+v", serr)
+	}
+}
+
+func TestHTMLTemplateEscapingErrorsAreReported(t *testing.T) {
+	content := strings.Replace(basicRenderedHtmlSimplate,
+		"<p>{{.D.Who}}", "<a href=\"{{.D.Who}}", 1)
+
+	s, err := newSimplateFromString("aspen_go_gen", "/tmp", "/tmp/basic-rendered.html", content)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if s.ValidateTemplates() == nil {
+		t.Errorf("HTML template ending in an attribute was not reported!")
+	}
+}
+
+func TestSiteBuilderRefusesToWriteBrokenTemplates(t *testing.T) {
 	mkTestSite()
 	if noCleanup {
 		fmt.Println("tmpdir =", tmpdir)
@@ -582,11 +1112,17 @@ func TestSiteBuilderExposesWwwRoot(t *testing.T) {
 		defer rmTmpDir()
 	}
 
+	broken := strings.Replace(basicRenderedTxtSimplate, "{{.D.Who}}", "{{.D.Who", 1)
+	err := ioutil.WriteFile(path.Join(testWwwRoot, "broken.txt"), []byte(broken), 0644)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
 	sb, err := newSiteBuilder(&SiteBuilderCfg{
 		WwwRoot:       testWwwRoot,
 		OutputGopath:  tmpdir,
 		GenServerBind: ":9182",
-		Format:        true,
 		MkOutDir:      true,
 	})
 	if err != nil {
@@ -594,13 +1130,24 @@ func TestSiteBuilderExposesWwwRoot(t *testing.T) {
 		return
 	}
 
-	if sb.WwwRoot != testWwwRoot {
-		t.Errorf("WwwRoot != %s: %s", testWwwRoot, sb.WwwRoot)
+	err = sb.Build()
+	if err == nil {
+		t.Errorf("Site with broken template built without error!")
+		return
+	}
+
+	sources, err := sb.sourcesList()
+	if err != nil {
+		t.Error(err)
 		return
 	}
+
+	if len(sources) > 0 {
+		t.Errorf("Sources were written for site with broken template: %v", sources)
+	}
 }
 
-func TestSiteBuilderExposesOutputDir(t *testing.T) {
+func TestSiteBuilderReportsEveryBrokenSimplate(t *testing.T) {
 	mkTestSite()
 	if noCleanup {
 		fmt.Println("tmpdir =", tmpdir)
@@ -608,11 +1155,24 @@ func TestSiteBuilderExposesOutputDir(t *testing.T) {
 		defer rmTmpDir()
 	}
 
+	broken := map[string]string{
+		"broken.txt":  strings.Replace(basicRenderedTxtSimplate, "{{.D.Who}}", "{{.D.Who", 1),
+		"broken.html": "\x0c\n\x0c\n\x0c\n\x0c\n",
+		"broken":      basicNegotiatedSimplate + "\x0c via\nhi\n",
+	}
+
+	for filePath, content := range broken {
+		err := ioutil.WriteFile(path.Join(testWwwRoot, filePath), []byte(content), 0644)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
 	sb, err := newSiteBuilder(&SiteBuilderCfg{
 		WwwRoot:       testWwwRoot,
 		OutputGopath:  tmpdir,
 		GenServerBind: ":9182",
-		Format:        true,
 		MkOutDir:      true,
 	})
 	if err != nil {
@@ -620,13 +1180,32 @@ func TestSiteBuilderExposesOutputDir(t *testing.T) {
 		return
 	}
 
-	if sb.OutputGopath != tmpdir {
-		t.Errorf("OutputDir != %s: %s", tmpdir, sb.OutputGopath)
+	err = sb.Build()
+	errs, ok := err.(MultiError)
+	if !ok || len(errs) != len(broken) {
+		t.Errorf("Build did not report all %d broken simplates: %v", len(broken), err)
 		return
 	}
+
+	codes := map[string]string{}
+	for _, err := range errs {
+		if serr, ok := err.(*SimplateError); ok {
+			codes[path.Base(serr.Filename)] = serr.Code
+		}
+	}
+
+	for filePath, code := range map[string]string{
+		"broken.txt":  SimplateErrorInvalidTemplate,
+		"broken.html": SimplateErrorUnexpectedExtension,
+		"broken":      SimplateErrorInvalidSpecline,
+	} {
+		if codes[filePath] != code {
+			t.Errorf("Error for %q has code %q instead of %q", filePath, codes[filePath], code)
+		}
+	}
 }
 
-func TestSiteBuilderBuildWritesSources(t *testing.T) {
+func TestSiteBuilderRebuildsOnlyChangedSimplates(t *testing.T) {
 	mkTestSite()
 	if noCleanup {
 		fmt.Println("tmpdir =", tmpdir)
@@ -634,36 +1213,95 @@ func TestSiteBuilderBuildWritesSources(t *testing.T) {
 		defer rmTmpDir()
 	}
 
-	sb, err := newSiteBuilder(&SiteBuilderCfg{
-		WwwRoot:       testWwwRoot,
-		OutputGopath:  tmpdir,
-		GenServerBind: ":9182",
-		MkOutDir:      true,
-		Compile:       false,
-	})
+	build := func() (*siteBuilder, error) {
+		sb, err := newSiteBuilder(&SiteBuilderCfg{
+			WwwRoot:       testWwwRoot,
+			OutputGopath:  tmpdir,
+			GenServerBind: ":9182",
+			MkOutDir:      true,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return sb, sb.writeSources()
+	}
+
+	sb, err := build()
 	if err != nil {
 		t.Error(err)
 		return
 	}
 
-	err = sb.Build()
+	if len(sb.summary.Added) != len(testSiteFiles) {
+		t.Errorf("First build summary is %v", sb.summary)
+	}
+
+	// outputs of unchanged simplates must be left alone
+	cansGo := path.Join(aspenGoGenDir, "shill-SLASH-cans-DOT-txt.go")
+	err = ioutil.WriteFile(cansGo, []byte("package aspen_go_gen\n"), 0644)
 	if err != nil {
 		t.Error(err)
 		return
 	}
 
-	fi, err := os.Stat(path.Join(aspenGoGenDir, "shill-SLASH-cans-DOT-txt.go"))
+	err = ioutil.WriteFile(path.Join(testWwwRoot, "shill", "dance.html"),
+		[]byte(strings.Replace(basicRenderedHtmlSimplate, "Dance", "Prance", -1)), 0644)
 	if err != nil {
 		t.Error(err)
 		return
 	}
 
-	if fi.Size() < int64(len(basicRenderedTxtSimplate)) {
-		t.Errorf("Generated file is too small! %v", fi.Size())
+	err = os.Remove(path.Join(testWwwRoot, "hat", "v.json"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	sb, err = build()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	summary := sb.summary
+	if len(summary.Added) != 0 || len(summary.Removed) != 1 ||
+		len(summary.Changed) != 1 || len(summary.Unchanged) != len(testSiteFiles)-2 {
+		t.Errorf("Second build summary is %v", summary)
+		return
+	}
+
+	if summary.Changed[0] != "/shill/dance.html" || summary.Removed[0] != "/hat/v.json" {
+		t.Errorf("Second build summary is %+v", summary)
+	}
+
+	cans, err := ioutil.ReadFile(cansGo)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if string(cans) != "package aspen_go_gen\n" {
+		t.Errorf("Unchanged simplate was regenerated")
+	}
+
+	_, err = os.Stat(path.Join(aspenGoGenDir, "hat-SLASH-v-DOT-json.go"))
+	if !os.IsNotExist(err) {
+		t.Errorf("Generated source of removed simplate was left behind: %v", err)
+	}
+
+	dance, err := ioutil.ReadFile(path.Join(aspenGoGenDir, "shill-SLASH-dance-DOT-html.go"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !bytes.Contains(dance, []byte("Prance")) {
+		t.Errorf("Changed simplate was not regenerated")
 	}
 }
 
-func TestSiteBuilderBuildFormatsSources(t *testing.T) {
+func TestSiteBuilderRebuildsChangedStaticFiles(t *testing.T) {
 	mkTestSite()
 	if noCleanup {
 		fmt.Println("tmpdir =", tmpdir)
@@ -671,95 +1309,2249 @@ func TestSiteBuilderBuildFormatsSources(t *testing.T) {
 		defer rmTmpDir()
 	}
 
-	sb, err := newSiteBuilder(&SiteBuilderCfg{
-		WwwRoot:       testWwwRoot,
-		OutputGopath:  tmpdir,
-		GenServerBind: ":9182",
-		Format:        true,
-		MkOutDir:      true,
-		Compile:       false,
-	})
-	if err != nil {
-		t.Error(err)
-		return
+	assets := map[string]string{
+		"img/logo.png":    "not really a PNG\n",
+		"assets/site.css": "body { color: red; }\n",
 	}
 
-	err = sb.Build()
+	writeAssets := func(suffix string) error {
+		for name, content := range assets {
+			assetPath := path.Join(testWwwRoot, name)
+			err := os.MkdirAll(path.Dir(assetPath), os.ModeDir|os.ModePerm)
+			if err != nil {
+				return err
+			}
+
+			err = ioutil.WriteFile(assetPath, []byte(content+suffix), 0644)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	build := func() (*siteBuilder, error) {
+		sb, err := newSiteBuilder(&SiteBuilderCfg{
+			WwwRoot:       testWwwRoot,
+			OutputGopath:  tmpdir,
+			GenServerBind: ":9182",
+			MkOutDir:      true,
+			StaticPaths:   []string{"assets"},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return sb, sb.writeSources()
+	}
+
+	err := writeAssets("")
 	if err != nil {
 		t.Error(err)
 		return
 	}
 
-	fileName := path.Join(aspenGoGenDir, "shill-SLASH-cans-DOT-txt.go")
-
-	fileContent, err := ioutil.ReadFile(fileName)
+	_, err = build()
 	if err != nil {
 		t.Error(err)
 		return
 	}
 
-	firstHash := sha1.New()
-	io.WriteString(firstHash, string(fileContent))
-	firstSum := fmt.Sprintf("%x", firstHash.Sum(nil))
-
-	err = formatAspenGoGen()
+	err = writeAssets("/* edited */\n")
 	if err != nil {
 		t.Error(err)
 		return
 	}
 
-	fileContent, err = ioutil.ReadFile(fileName)
+	sb, err := build()
 	if err != nil {
 		t.Error(err)
 		return
 	}
 
-	secondHash := sha1.New()
-	io.WriteString(secondHash, string(fileContent))
-	secondSum := fmt.Sprintf("%x", secondHash.Sum(nil))
+	changed := map[string]bool{}
+	for _, requestPath := range sb.summary.Changed {
+		changed[requestPath] = true
+	}
 
-	if firstSum != secondSum {
-		t.Errorf("Hash for %q changed!", fileName)
+	for name := range assets {
+		if !changed["/"+name] {
+			t.Errorf("Edited static file %q isn't changed in %+v", name, sb.summary)
+		}
 	}
 }
 
-func TestNewSiteBuilderCompilesSources(t *testing.T) {
-	mkTestSite()
+func TestRenderedSimplateOutputIsValidGoSource(t *testing.T) {
+	mkTmpDir()
 	if noCleanup {
 		fmt.Println("tmpdir =", tmpdir)
 	} else {
 		defer rmTmpDir()
 	}
 
-	sb, err := newSiteBuilder(&SiteBuilderCfg{
-		WwwRoot:       testWwwRoot,
-		OutputGopath:  tmpdir,
-		GenServerBind: ":9182",
-		Format:        true,
-		Compile:       true,
-		MkOutDir:      true,
-	})
+	outfileName, err := writeRenderedTemplate()
 	if err != nil {
 		t.Error(err)
 		return
 	}
 
-	err = sb.Build()
+	fset := token.NewFileSet()
+	_, err = parser.ParseFile(fset, outfileName, nil, parser.DeclarationErrors)
 	if err != nil {
 		t.Error(err)
 		return
 	}
+}
 
-	serverBinary := path.Join(sb.OutputGopath, "bin", "aspen_go_gen-http-server")
+func TestGeneratedSourcePositionsMapToSimplate(t *testing.T) {
+	s, err := newSimplateFromString("aspen_go_gen", "/tmp", "/tmp/basic-rendered.txt", basicRenderedTxtSimplate)
+	if err != nil {
+		t.Error(err)
+		return
+	}
 
-	fi, err := os.Stat(serverBinary)
+	var out bytes.Buffer
+	err = s.Execute(&out)
 	if err != nil {
 		t.Error(err)
 		return
 	}
 
-	if fi.Mode() != (os.FileMode)(0750) {
-		t.Errorf("Site server binary %q permissions != %v: %v",
-			serverBinary, (os.FileMode)(0750), fi.Mode())
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "/tmp/basic-DASH-rendered-DOT-txt.go", out.Bytes(), parser.ParseComments)
+	if err != nil {
+		t.Error(err)
+		return
 	}
+
+	positions := map[string]token.Position{}
+	ast.Inspect(f, func(node ast.Node) bool {
+		switch n := node.(type) {
+		case *ast.TypeSpec:
+			positions["type"] = fset.Position(n.Pos())
+		case *ast.CompositeLit:
+			if ident, ok := n.Type.(*ast.Ident); ok && strings.HasPrefix(ident.Name, "RDance") {
+				positions["logic"] = fset.Position(n.Pos())
+			}
+		case *ast.BasicLit:
+			if strings.Contains(n.Value, "{{.D.Who}}") {
+				positions["template"] = fset.Position(n.Pos())
+			}
+		case *ast.FuncDecl:
+			positions["func"] = fset.Position(n.Pos())
+		}
+		return true
+	})
+
+	expected := map[string]token.Position{
+		"type":     {Filename: "/tmp/basic-rendered.txt", Line: 6},
+		"logic":    {Filename: "/tmp/basic-rendered.txt", Line: 11},
+		"template": {Filename: "/tmp/basic-rendered.txt", Line: 16},
+	}
+
+	for what, pos := range expected {
+		if positions[what].Filename != pos.Filename || positions[what].Line != pos.Line {
+			t.Errorf("Position of %s is %v instead of %s:%d", what,
+				positions[what], pos.Filename, pos.Line)
+		}
+	}
+
+	if positions["func"].Filename != "/tmp/basic-DASH-rendered-DOT-txt.go" {
+		t.Errorf("Generated func position not mapped to generated file: %v",
+			positions["func"])
+	}
+}
+
+func TestCompileErrorsReferToSimplate(t *testing.T) {
+	mkTmpDir()
+	if noCleanup {
+		fmt.Println("tmpdir =", tmpdir)
+	} else {
+		defer rmTmpDir()
+	}
+
+	content := strings.Replace(basicRenderedTxtSimplate,
+		"When: time.Now(),", "When: time.Now(),\n    Wat: 1,", 1)
+
+	s, err := newSimplateFromString("aspen_go_gen", "/tmp", "/tmp/broken.txt", content)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	outf, err := os.Create(path.Join(aspenGoGenDir, s.OutputName()))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = s.Execute(outf)
+	outf.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	cmdOut, err := exec.Command(goCmd, "build", "aspen_go_gen").CombinedOutput()
+	if err == nil {
+		t.Errorf("Broken simplate compiled!")
+		return
+	}
+
+	if !strings.Contains(string(cmdOut), "/tmp/broken.txt:14") {
+		t.Errorf("Compile error does not refer to simplate line: %s", cmdOut)
+	}
+}
+
+func TestRenderedSimplateCanBeCompiled(t *testing.T) {
+	mkTmpDir()
+	if noCleanup {
+		fmt.Println("tmpdir =", tmpdir)
+	} else {
+		defer rmTmpDir()
+	}
+
+	_, err := writeRenderedTemplate()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = formatAspenGoGen()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = buildAspenGoGen()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestTreeWalkerRequiresNonEmptyPackageName(t *testing.T) {
+	_, err := newTreeWalker("", os.TempDir())
+	if err == nil {
+		t.Errorf("New tree walker failed to reject empty package")
+		return
+	}
+}
+
+func TestTreeWalkerRequiresValidDirectoryRoot(t *testing.T) {
+	_, err := newTreeWalker("aspen_go_gen", path.Join(tmpdir, "dev/null"))
+	if err == nil {
+		t.Errorf("New tree walker failed to reject invalid dir!")
+		return
+	}
+}
+
+func TestTreeWalkerYieldsSimplates(t *testing.T) {
+	siteRoot := mkTestSite()
+	if noCleanup {
+		fmt.Println("tmpdir =", tmpdir)
+	} else {
+		defer rmTmpDir()
+	}
+
+	tw, err := newTreeWalker("aspen_go_gen", siteRoot)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	n := 0
+
+	simplates, err := tw.Simplates()
+	if err != nil {
+		t.Error(err)
+	}
+
+	for _, simplate := range simplates {
+		if sort.SearchStrings(SimplateTypes, simplate.Type) < 0 {
+			t.Errorf("Simplate yielded with invalid type: %v", simplate.Type)
+			return
+		}
+		n++
+	}
+
+	if n != 7 {
+		t.Errorf("Tree walking yielded unexpected number of files: %v", n)
+	}
+}
+
+func TestTreeWalkerTreatsBinaryFilesAsStatic(t *testing.T) {
+	siteRoot := mkTestSite()
+	if noCleanup {
+		fmt.Println("tmpdir =", tmpdir)
+	} else {
+		defer rmTmpDir()
+	}
+
+	files := map[string]string{
+		"img/logo.png":       "\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR\x0c\x0c\x00",
+		"img/blob":           "\x00\x0c\n\x0c text/plain\nhi\n",
+		"fonts/serif.woff":   basicRenderedTxtSimplate,
+		"assets/copied.txt":  basicRenderedTxtSimplate,
+		"shill/verbatim.txt": basicRenderedTxtSimplate,
+	}
+
+	for filePath, content := range files {
+		fullPath := path.Join(siteRoot, filePath)
+		err := os.MkdirAll(path.Dir(fullPath), os.ModeDir|os.ModePerm)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		err = ioutil.WriteFile(fullPath, []byte(content), 0644)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	tw, err := newTreeWalker("aspen_go_gen", siteRoot)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	tw.StaticPaths = []string{"assets", "shill/verbatim.*"}
+
+	simplates, err := tw.Simplates()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	types := map[string]string{}
+	for _, simplate := range simplates {
+		types[filepath.ToSlash(simplate.Filename)] = simplate.Type
+	}
+
+	for filePath, _ := range files {
+		if types[filePath] != SimplateTypeStatic {
+			t.Errorf("File %q was walked as a %q simplate", filePath, types[filePath])
+		}
+	}
+
+	if types["shill/cans.txt"] != SimplateTypeRendered {
+		t.Errorf("Rendered simplate was walked as %q", types["shill/cans.txt"])
+	}
+}
+
+func TestIgnoreMatcherFollowsGitignoreRules(t *testing.T) {
+	content := []byte(`
+# build output
+/build/
+*.log
+!keep.log
+docs/**/draft.*
+\#literal
+!.well-known/
+`)
+
+	im, err := newIgnoreMatcher(IgnoreFilename, content)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for relPath, expected := range map[string]bool{
+		".git":                           true,
+		".git/config":                    true,
+		"foo/.hidden.txt":                true,
+		"foo/.index.html.swp":            true,
+		"foo/#index.html#":               true,
+		"foo/index.html~":                true,
+		"node_modules/x/index.js":        true,
+		"build/out.txt":                  true,
+		"src/build/out.txt":              false,
+		"error.log":                      true,
+		"logs/error.log":                 true,
+		"logs/keep.log":                  false,
+		"docs/draft.md":                  true,
+		"docs/a/b/draft.txt":             true,
+		"other/docs/draft.md":            false,
+		"#literal":                       true,
+		".well-known/security.txt":       false,
+		"index.html":                     false,
+		"Big CMS/Owns_UR Contents/x.txt": false,
+	} {
+		if im.Ignored(relPath, false) != expected {
+			t.Errorf("Ignored(%q) != %v", relPath, expected)
+		}
+	}
+
+	if !im.Ignored("build", true) || im.Ignored("build", false) {
+		t.Errorf("Directory-only pattern matched incorrectly")
+	}
+}
+
+func TestTreeWalkerSkipsIgnoredPaths(t *testing.T) {
+	siteRoot := mkTestSite()
+	if noCleanup {
+		fmt.Println("tmpdir =", tmpdir)
+	} else {
+		defer rmTmpDir()
+	}
+
+	files := map[string]string{
+		IgnoreFilename:            "hams/\n",
+		".git/broken":             "\x0c\n\x0c\n",
+		"shill/.cans.txt.swp":     "\x0c\n\x0c\n",
+		"node_modules/broken.txt": "\x0c\n\x0c\n\x0c\n\x0c\n",
+	}
+
+	for filePath, content := range files {
+		fullPath := path.Join(siteRoot, filePath)
+		err := os.MkdirAll(path.Dir(fullPath), os.ModeDir|os.ModePerm)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		err = ioutil.WriteFile(fullPath, []byte(content), 0644)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	tw, err := newTreeWalker("aspen_go_gen", siteRoot)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	simplates, err := tw.Simplates()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	n := 0
+	for _, simplate := range simplates {
+		if strings.HasPrefix(filepath.ToSlash(simplate.Filename), "hams/") {
+			t.Errorf("Ignored simplate %q was walked", simplate.Filename)
+		}
+		n++
+	}
+
+	if n != 6 {
+		t.Errorf("Tree walking yielded unexpected number of files: %v", n)
+	}
+}
+
+func TestStaticHandlerDoesNotServeIgnoredPaths(t *testing.T) {
+	siteRoot := mkTestSite()
+	if noCleanup {
+		fmt.Println("tmpdir =", tmpdir)
+	} else {
+		defer rmTmpDir()
+	}
+
+	err := ioutil.WriteFile(path.Join(siteRoot, "shill", ".secret.txt"), []byte("psst"), 0644)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	sh := &websiteStaticHandler{w: &Website{WwwRoot: siteRoot, ListDirs: true}}
+
+	for requestPath, expected := range map[string]int{
+		"/shill/.secret.txt": http.StatusNotFound,
+		"/shill/cans.txt":    http.StatusOK,
+	} {
+		w := httptest.NewRecorder()
+		sh.ServeHTTP(w, httptest.NewRequest("GET", requestPath, nil))
+		if w.Code != expected {
+			t.Errorf("Request for %q got status %d instead of %d", requestPath, w.Code, expected)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	sh.ServeHTTP(w, httptest.NewRequest("GET", "/shill/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Directory listing got status %d", w.Code)
+		return
+	}
+
+	if strings.Contains(w.Body.String(), ".secret.txt") ||
+		!strings.Contains(w.Body.String(), "cans.txt") {
+		t.Errorf("Directory listing didn't omit ignored files: %s", w.Body.String())
+	}
+}
+
+func TestTreeWalkerJobsDoNotAffectOrder(t *testing.T) {
+	siteRoot := mkLargeTestSite(20)
+	if noCleanup {
+		fmt.Println("tmpdir =", tmpdir)
+	} else {
+		defer rmTmpDir()
+	}
+
+	filenames := map[int][]string{}
+	for _, jobs := range []int{1, 8} {
+		tw, err := newTreeWalker("aspen_go_gen", siteRoot)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		tw.Jobs = jobs
+
+		simplates, err := tw.Simplates()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		for _, simplate := range simplates {
+			filenames[jobs] = append(filenames[jobs], simplate.Filename)
+		}
+	}
+
+	if len(filenames[1]) != 21*len(testSiteFiles) {
+		t.Errorf("Tree walking yielded unexpected number of files: %v", len(filenames[1]))
+	}
+
+	if strings.Join(filenames[1], "\n") != strings.Join(filenames[8], "\n") {
+		t.Errorf("Simplates walked with 8 jobs are out of order: %v", filenames[8])
+	}
+}
+
+func TestSimplateErrorsHaveLocation(t *testing.T) {
+	_, err := newSimplateFromString("aspen_go_gen", "/tmp", "/tmp/hork.txt", "foo\n\x0c\n\x0c\n  \x0c\nbar\n")
+	serr, ok := err.(*SimplateError)
+	if !ok {
+		t.Errorf("Expected a *SimplateError, got %#v", err)
+		return
+	}
+
+	if serr.Code != SimplateErrorUnexpectedExtension || serr.Page != 3 ||
+		serr.Line != 4 || serr.Column != 3 {
+		t.Errorf("Simplate error has unexpected location or code: %+v", serr)
+	}
+
+	if !strings.HasPrefix(serr.Error(), "/tmp/hork.txt:4:3: ") {
+		t.Errorf("Simplate error is not in file:line:col form: %v", serr)
+	}
+}
+
+func TestParsesSpeclineGrammar(t *testing.T) {
+	for specline, expected := range map[string][3]string{
+		"":                               {"", "", ""},
+		"text/plain":                     {"text/plain", "", ""},
+		"via markdown":                   {"", "", RendererMarkdown},
+		"text/html via go/text/template": {"text/html", "", RendererGoTextTemplate},
+		"text/html; charset=utf-8 via #!markdown": {"text/html", "utf-8", RendererMarkdown},
+		"Text/HTML; charset=UTF-8":                {"text/html", "UTF-8", ""},
+		"text/plain #!go/text/template":           {"text/plain", "", RendererGoTextTemplate},
+		"#!markdown":                              {"", "", RendererMarkdown},
+	} {
+		mediaType, params, renderer, err := parseSpecline(specline)
+		if err != nil {
+			t.Errorf("Specline %q was rejected: %v", specline, err)
+			continue
+		}
+
+		actual := [3]string{mediaType, params["charset"], renderer}
+		if actual != expected {
+			t.Errorf("Specline %q parsed as %q instead of %q", specline, actual, expected)
+		}
+	}
+}
+
+func TestRejectsMalformedSpeclines(t *testing.T) {
+	for _, specline := range []string{
+		"via",
+		"text/plain via",
+		"via go/text/template text/plain",
+		"text/plain via markdown extra",
+		"#!markdown text/plain",
+		"text/plain; charset",
+		"text",
+		"text/",
+		"text/plain text/html",
+	} {
+		_, _, _, err := parseSpecline(specline)
+		if err == nil {
+			t.Errorf("Malformed specline %q was not rejected", specline)
+		}
+	}
+}
+
+func TestNegotiatedSpeclineParamsAreNotNegotiated(t *testing.T) {
+	content := basicNegotiatedSimplate + "\x0c text/html; charset=utf-8 via markdown\n# Hi\n"
+
+	s, err := newSimplateFromString("aspen_go_gen", "/tmp", "/tmp/hork", content)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	spec := s.TemplatePages[2].Spec
+	if spec.ContentType != "text/html" || spec.Renderer != RendererMarkdown {
+		t.Errorf("Page spec parsed as %+v", spec)
+	}
+
+	if spec.MediaType() != "text/html; charset=utf-8" {
+		t.Errorf("Page media type is %q", spec.MediaType())
+	}
+}
+
+func TestRenderedSpeclineMediaTypeMustMatchExtension(t *testing.T) {
+	content := strings.Replace(basicRenderedHtmlSimplate,
+		"\x0c\n<p>", "\x0c text/plain via go/text/template\n<p>", 1)
+
+	_, err := newSimplateFromString("aspen_go_gen", "/tmp", "/tmp/basic-rendered.html", content)
+	serr, ok := err.(*SimplateError)
+	if !ok || serr.Code != SimplateErrorInvalidSpecline {
+		t.Errorf("Mismatched media type was not rejected: %#v", err)
+	}
+
+	content = strings.Replace(basicRenderedHtmlSimplate,
+		"\x0c\n<p>", "\x0c text/html; charset=utf-8 via go/text/template\n<p>", 1)
+
+	s, err := newSimplateFromString("aspen_go_gen", "/tmp", "/tmp/basic-rendered.html", content)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	spec := s.FirstTemplatePage().Spec
+	if spec.Renderer != RendererGoTextTemplate || spec.ContentType != "text/html" ||
+		spec.MediaType() != "text/html; charset=utf-8" {
+		t.Errorf("Rendered page spec parsed as %+v", spec)
+	}
+}
+
+func TestInvalidSpeclineErrorsHaveLocation(t *testing.T) {
+	content := basicNegotiatedSimplate + "\x0c text/html #!go/text/template wat\n<p>hi</p>\n"
+
+	_, err := newSimplateFromString("aspen_go_gen", "/tmp", "/tmp/hork", content)
+	serr, ok := err.(*SimplateError)
+	if !ok {
+		t.Errorf("Expected a *SimplateError, got %#v", err)
+		return
+	}
+
+	if serr.Code != SimplateErrorInvalidSpecline || serr.Page != 4 || serr.Line != 20 {
+		t.Errorf("Simplate error has unexpected location or code: %+v", serr)
+	}
+}
+
+func TestTreeWalkerCollectsAllSimplateErrors(t *testing.T) {
+	siteRoot := mkTestSite()
+	if noCleanup {
+		fmt.Println("tmpdir =", tmpdir)
+	} else {
+		defer rmTmpDir()
+	}
+
+	for _, broken := range []string{"broken/one", "broken/two"} {
+		err := os.MkdirAll(path.Join(siteRoot, "broken"), os.ModeDir|os.ModePerm)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		err = ioutil.WriteFile(path.Join(siteRoot, broken), []byte("\x0c\n\x0c\n"), 0644)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	tw, err := newTreeWalker("aspen_go_gen", siteRoot)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	simplates, err := tw.Simplates()
+	if len(simplates) != len(testSiteFiles) {
+		t.Errorf("Tree walking yielded unexpected number of files: %v", len(simplates))
+	}
+
+	errs, ok := err.(MultiError)
+	if !ok || len(errs) != 2 {
+		t.Errorf("Tree walker did not collect both broken simplates: %v", err)
+		return
+	}
+
+	for i, broken := range []string{"broken/one", "broken/two"} {
+		serr, ok := errs[i].(*SimplateError)
+		if !ok || serr.Filename != path.Join(siteRoot, broken) {
+			t.Errorf("Tree walker error %d is not for %q: %v", i, broken, errs[i])
+		}
+	}
+}
+
+func TestNewSiteBuilderRequiresValidWwwRoot(t *testing.T) {
+	_, err := newSiteBuilder(&SiteBuilderCfg{
+		WwwRoot:       path.Join(tmpdir, "dev/null"),
+		OutputGopath:  ".",
+		GenServerBind: ":9182",
+	})
+	if err == nil {
+		t.Errorf("New site builder failed to reject invalid root dir!")
+	}
+}
+
+func TestNewSiteBuilderRequiresValidOutputDir(t *testing.T) {
+	_, err := newSiteBuilder(&SiteBuilderCfg{
+		WwwRoot:       ".",
+		OutputGopath:  path.Join(tmpdir, "dev/null"),
+		GenServerBind: ":9182",
+	})
+	if err == nil {
+		t.Errorf("New site builder failed to reject invalid output dir!")
+	}
+}
+
+func TestNewSiteBuilderDefaultsGeneratedCodePackage(t *testing.T) {
+	sb, err := newSiteBuilder(&SiteBuilderCfg{
+		WwwRoot:       ".",
+		OutputGopath:  ".",
+		GenServerBind: ":9182",
+	})
+
+	if err != nil {
+		t.Error(err)
+	}
+
+	if sb.GenPackage != "aspen_go_gen" {
+		t.Errorf("Generated package default != \"aspen_go_gen\": %q", sb.GenPackage)
+	}
+}
+
+func TestSiteBuilderExposesWwwRoot(t *testing.T) {
+	mkTestSite()
+	if noCleanup {
+		fmt.Println("tmpdir =", tmpdir)
+	} else {
+		defer rmTmpDir()
+	}
+
+	sb, err := newSiteBuilder(&SiteBuilderCfg{
+		WwwRoot:       testWwwRoot,
+		OutputGopath:  tmpdir,
+		GenServerBind: ":9182",
+		Format:        true,
+		MkOutDir:      true,
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if sb.WwwRoot != testWwwRoot {
+		t.Errorf("WwwRoot != %s: %s", testWwwRoot, sb.WwwRoot)
+		return
+	}
+}
+
+func TestSiteBuilderExposesOutputDir(t *testing.T) {
+	mkTestSite()
+	if noCleanup {
+		fmt.Println("tmpdir =", tmpdir)
+	} else {
+		defer rmTmpDir()
+	}
+
+	sb, err := newSiteBuilder(&SiteBuilderCfg{
+		WwwRoot:       testWwwRoot,
+		OutputGopath:  tmpdir,
+		GenServerBind: ":9182",
+		Format:        true,
+		MkOutDir:      true,
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if sb.OutputGopath != tmpdir {
+		t.Errorf("OutputDir != %s: %s", tmpdir, sb.OutputGopath)
+		return
+	}
+}
+
+func TestSiteBuilderBuildWritesSources(t *testing.T) {
+	mkTestSite()
+	if noCleanup {
+		fmt.Println("tmpdir =", tmpdir)
+	} else {
+		defer rmTmpDir()
+	}
+
+	sb, err := newSiteBuilder(&SiteBuilderCfg{
+		WwwRoot:       testWwwRoot,
+		OutputGopath:  tmpdir,
+		GenServerBind: ":9182",
+		MkOutDir:      true,
+		Compile:       false,
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = sb.Build()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	fi, err := os.Stat(path.Join(aspenGoGenDir, "shill-SLASH-cans-DOT-txt.go"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if fi.Size() < int64(len(basicRenderedTxtSimplate)) {
+		t.Errorf("Generated file is too small! %v", fi.Size())
+	}
+}
+
+func TestSiteBuilderReportsUnformattableSourceAgainstSimplate(t *testing.T) {
+	mkTestSite()
+	if noCleanup {
+		fmt.Println("tmpdir =", tmpdir)
+	} else {
+		defer rmTmpDir()
+	}
+
+	broken := strings.Replace(basicRenderedTxtSimplate, "ctx[\"D\"] = &RDance{", "ctx[\"D\"] = &RDance{{", 1)
+	brokenPath := path.Join(testWwwRoot, "shill", "cans.txt")
+	err := ioutil.WriteFile(brokenPath, []byte(broken), 0644)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	sb, err := newSiteBuilder(&SiteBuilderCfg{
+		WwwRoot:       testWwwRoot,
+		OutputGopath:  tmpdir,
+		GenServerBind: ":9182",
+		Format:        true,
+		MkOutDir:      true,
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = sb.writeSources()
+	errs, ok := err.(MultiError)
+	if !ok || len(errs) != 1 {
+		t.Errorf("Expected one code generation error, got %v", err)
+		return
+	}
+
+	serr, ok := errs[0].(*SimplateError)
+	if !ok || serr.Code != SimplateErrorCodegen || serr.Filename != brokenPath || serr.Line == 0 {
+		t.Errorf("Code generation error doesn't locate the simplate: %#v", errs[0])
+	}
+}
+
+func TestSiteBuilderBuildFormatsSources(t *testing.T) {
+	mkTestSite()
+	if noCleanup {
+		fmt.Println("tmpdir =", tmpdir)
+	} else {
+		defer rmTmpDir()
+	}
+
+	sb, err := newSiteBuilder(&SiteBuilderCfg{
+		WwwRoot:       testWwwRoot,
+		OutputGopath:  tmpdir,
+		GenServerBind: ":9182",
+		Format:        true,
+		MkOutDir:      true,
+		Compile:       false,
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = sb.Build()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	fileName := path.Join(aspenGoGenDir, "shill-SLASH-cans-DOT-txt.go")
+
+	fileContent, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	firstHash := sha1.New()
+	io.WriteString(firstHash, string(fileContent))
+	firstSum := fmt.Sprintf("%x", firstHash.Sum(nil))
+
+	err = formatAspenGoGen()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	fileContent, err = ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	secondHash := sha1.New()
+	io.WriteString(secondHash, string(fileContent))
+	secondSum := fmt.Sprintf("%x", secondHash.Sum(nil))
+
+	if firstSum != secondSum {
+		t.Errorf("Hash for %q changed!", fileName)
+	}
+}
+
+func TestSiteBuilderTypeChecksSources(t *testing.T) {
+	mkTestSite()
+	if noCleanup {
+		fmt.Println("tmpdir =", tmpdir)
+	} else {
+		defer rmTmpDir()
+	}
+
+	sb, err := newSiteBuilder(&SiteBuilderCfg{
+		WwwRoot:       testWwwRoot,
+		OutputGopath:  tmpdir,
+		GenServerBind: ":9182",
+		MkOutDir:      true,
+		TypeCheck:     true,
+		Compile:       false,
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = sb.Build()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSiteBuilderTypeChecksSourcesWithoutCompiling(t *testing.T) {
+	mkTestSite()
+	if noCleanup {
+		fmt.Println("tmpdir =", tmpdir)
+	} else {
+		defer rmTmpDir()
+	}
+
+	sb, err := newSiteBuilder(&SiteBuilderCfg{
+		WwwRoot:       testWwwRoot,
+		OutputGopath:  tmpdir,
+		GenServerBind: ":9182",
+		MkOutDir:      true,
+		TypeCheck:     true,
+		Compile:       false,
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(sb.goexe) == 0 {
+		t.Errorf("Site builder that type-checks has no go tool")
+		return
+	}
+
+	err = sb.Build()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = os.Stat(sb.ServerBinary)
+	if !os.IsNotExist(err) {
+		t.Errorf("Site builder compiled a server binary: %v", err)
+	}
+}
+
+func TestSiteBuilderTypeChecksSourcesWithModulesUnset(t *testing.T) {
+	mkTestSite()
+	if noCleanup {
+		fmt.Println("tmpdir =", tmpdir)
+	} else {
+		defer rmTmpDir()
+	}
+
+	if go111module, ok := os.LookupEnv("GO111MODULE"); ok {
+		defer os.Setenv("GO111MODULE", go111module)
+	}
+
+	err := os.Unsetenv("GO111MODULE")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	sb, err := newSiteBuilder(&SiteBuilderCfg{
+		WwwRoot:       testWwwRoot,
+		OutputGopath:  tmpdir,
+		GenServerBind: ":9182",
+		MkOutDir:      true,
+		TypeCheck:     true,
+		Compile:       false,
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = sb.Build()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+const isolatedSimplate = "\ntype Dance struct {\n    Dance string\n}\n\n" +
+	"func (d *Dance) load() string {\n    return d.Dance\n}\n\n" +
+	"func load() *Dance {\n    return &Dance{Dance: \"%s\"}\n}\n\n" +
+	"var ctx = load()\n" +
+	"\x0c\nctx[\"D\"] = load().load()\n\x0c\n{{.D}}\n"
+
+func TestSimplatesMayDeclareTheSameNames(t *testing.T) {
+	mkTestSite()
+	if noCleanup {
+		fmt.Println("tmpdir =", tmpdir)
+	} else {
+		defer rmTmpDir()
+	}
+
+	for _, filePath := range []string{"dance/one.txt", "dance/two.txt"} {
+		fullPath := path.Join(testWwwRoot, filePath)
+		err := os.MkdirAll(path.Dir(fullPath), os.ModeDir|os.ModePerm)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		err = ioutil.WriteFile(fullPath, []byte(fmt.Sprintf(isolatedSimplate, filePath)), 0644)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	sb, err := newSiteBuilder(&SiteBuilderCfg{
+		WwwRoot:       testWwwRoot,
+		OutputGopath:  tmpdir,
+		GenServerBind: ":9182",
+		MkOutDir:      true,
+		TypeCheck:     true,
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = sb.Build()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	src, err := ioutil.ReadFile(path.Join(aspenGoGenDir, "dance-SLASH-one-DOT-txt.go"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, expected := range []string{
+		"type Dance__dance_SLASH_one_DOT_txt struct",
+		"func (d *Dance__dance_SLASH_one_DOT_txt) load() string",
+		"return &Dance__dance_SLASH_one_DOT_txt{Dance: ",
+		"var ctx__dance_SLASH_one_DOT_txt = load__dance_SLASH_one_DOT_txt()",
+		"ctx[\"D\"] = load__dance_SLASH_one_DOT_txt().load()",
+	} {
+		if !bytes.Contains(src, []byte(expected)) {
+			t.Errorf("Generated source lacks %q:\n%s", expected, src)
+		}
+	}
+}
+
+func TestIsolatedNamesAreRestoredInTypeErrors(t *testing.T) {
+	mkTestSite()
+	if noCleanup {
+		fmt.Println("tmpdir =", tmpdir)
+	} else {
+		defer rmTmpDir()
+	}
+
+	err := ioutil.WriteFile(path.Join(testWwwRoot, "broken.txt"),
+		[]byte("\ntype Dance struct{}\n\x0c\nvar d Dance = 1\nctx[\"D\"] = d\n\x0c\n{{.D}}\n"), 0644)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	sb, err := newSiteBuilder(&SiteBuilderCfg{
+		WwwRoot:       testWwwRoot,
+		OutputGopath:  tmpdir,
+		GenServerBind: ":9182",
+		MkOutDir:      true,
+		TypeCheck:     true,
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = sb.Build()
+	if err == nil {
+		t.Errorf("Broken simplate was built")
+		return
+	}
+
+	if !strings.Contains(err.Error(), "Dance") || strings.Contains(err.Error(), "Dance__") {
+		t.Errorf("Type error doesn't use the declared name: %v", err)
+	}
+}
+
+func TestSiteBuilderSharesLibrarySources(t *testing.T) {
+	mkTestSite()
+	if noCleanup {
+		fmt.Println("tmpdir =", tmpdir)
+	} else {
+		defer rmTmpDir()
+	}
+
+	files := map[string]string{
+		"_lib/shout.go":      "// Helpers for every simplate\npackage lib\n\nimport \"strings\"\n\nfunc Shout(s string) string {\n\treturn strings.ToUpper(s) + \"!\"\n}\n",
+		"_lib/shout_test.go": "package lib\n\nthis is not go\n",
+		"shout.txt":          "\x0c\nctx[\"S\"] = Shout(\"hams\")\n\x0c\n{{.S}}\n",
+	}
+
+	for filePath, content := range files {
+		fullPath := path.Join(testWwwRoot, filePath)
+		err := os.MkdirAll(path.Dir(fullPath), os.ModeDir|os.ModePerm)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		err = ioutil.WriteFile(fullPath, []byte(content), 0644)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	cfg := &SiteBuilderCfg{
+		WwwRoot:       testWwwRoot,
+		OutputGopath:  tmpdir,
+		GenServerBind: ":9182",
+		MkOutDir:      true,
+		TypeCheck:     true,
+	}
+
+	sb, err := newSiteBuilder(cfg)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = sb.Build()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	lib, err := ioutil.ReadFile(path.Join(aspenGoGenDir, "aspen-lib-shout.go"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	expected := "//line " + path.Join(testWwwRoot, "_lib", "shout.go") +
+		":1\n// Helpers for every simplate\npackage aspen_go_gen\n"
+	if !strings.HasPrefix(string(lib), expected) {
+		t.Errorf("Library source wasn't copied into the generated package:\n%s", lib)
+	}
+
+	_, err = os.Stat(path.Join(aspenGoGenDir, "aspen-lib-shout_test.go"))
+	if !os.IsNotExist(err) {
+		t.Errorf("Library test source was copied: %v", err)
+	}
+
+	if _, ok := sb.simplates[path.Join(testWwwRoot, "_lib", "shout.go")]; ok {
+		t.Errorf("Library source was walked as a simplate")
+	}
+
+	sh := &websiteStaticHandler{w: &Website{WwwRoot: testWwwRoot, ListDirs: true}}
+	for _, requestPath := range []string{"/_lib/shout.go", "/_lib/"} {
+		w := httptest.NewRecorder()
+		sh.ServeHTTP(w, httptest.NewRequest("GET", requestPath, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Request for %q got status %d", requestPath, w.Code)
+		}
+	}
+
+	// errors in library sources are reported against them
+	err = ioutil.WriteFile(path.Join(testWwwRoot, "_lib", "shout.go"),
+		[]byte("package lib\n\nfunc Shout(s string) string {\n\treturn 1\n}\n"), 0644)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	sb, err = newSiteBuilder(cfg)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = sb.Build()
+	if err == nil || !strings.Contains(err.Error(), path.Join(testWwwRoot, "_lib", "shout.go")+":4:") {
+		t.Errorf("Library type error not reported against library source: %v", err)
+	}
+
+	// copies of removed library sources are removed
+	err = os.RemoveAll(path.Join(testWwwRoot, "_lib"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = os.Remove(path.Join(testWwwRoot, "shout.txt"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	sb, err = newSiteBuilder(cfg)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = sb.Build()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = os.Stat(path.Join(aspenGoGenDir, "aspen-lib-shout.go"))
+	if !os.IsNotExist(err) {
+		t.Errorf("%q was left behind: %v", "aspen-lib-shout.go", err)
+	}
+
+	// the library directory is declared even when it holds no Go sources
+	_, err = os.Stat(path.Join(aspenGoGenDir, "aspen-lib.go"))
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSiteBuilderDeclaresLibDirWithoutGoSources(t *testing.T) {
+	mkTestSite()
+	if noCleanup {
+		fmt.Println("tmpdir =", tmpdir)
+	} else {
+		defer rmTmpDir()
+	}
+
+	dataPath := path.Join(testWwwRoot, "private", "data", "secrets.csv")
+	err := os.MkdirAll(path.Dir(dataPath), os.ModeDir|os.ModePerm)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = ioutil.WriteFile(dataPath, []byte("hams,bone\n"), 0644)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	sb, err := newSiteBuilder(&SiteBuilderCfg{
+		WwwRoot:       testWwwRoot,
+		OutputGopath:  tmpdir,
+		GenServerBind: ":9182",
+		MkOutDir:      true,
+		LibDir:        "private",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = sb.Build()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	libInit, err := ioutil.ReadFile(path.Join(aspenGoGenDir, "aspen-lib.go"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !strings.Contains(string(libInit), `.SetLibDir("private")`) {
+		t.Errorf("Generated package doesn't declare the library directory:\n%s", libInit)
+	}
+
+	w := &Website{WwwRoot: testWwwRoot, ListDirs: true}
+	w.SetLibDir("private")
+	sh := &websiteStaticHandler{w: w}
+	for _, requestPath := range []string{"/private/", "/private/data/secrets.csv"} {
+		rec := httptest.NewRecorder()
+		sh.ServeHTTP(rec, httptest.NewRequest("GET", requestPath, nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("Request for %q got status %d", requestPath, rec.Code)
+		}
+	}
+}
+
+func TestGuessPackageName(t *testing.T) {
+	for importPath, expected := range map[string]string{
+		"net/http":                    "http",
+		"github.com/zetaweb/aspen-go": "aspen",
+		"github.com/mattn/go-sqlite3": "sqlite3",
+		"gopkg.in/yaml.v2":            "yaml",
+		"github.com/foo/bar/v3":       "bar",
+	} {
+		if name := guessPackageName(importPath); name != expected {
+			t.Errorf("Guessed package name of %q is %q instead of %q", importPath, name, expected)
+		}
+	}
+}
+
+func TestMergeImportsDropsDuplicatesAndAliasesClashes(t *testing.T) {
+	initImports := []*importSpec{
+		{Path: "net/http"},
+		{Path: "time"},
+		{Path: "html/template"},
+		{Name: "_", Path: "image/png"},
+		{Name: "_", Path: "image/png"},
+		{Name: "htmltemplate", Path: "html/template"},
+	}
+
+	merged, aliased := mergeImports([]*importSpec{
+		{Path: "net/http"},
+		{Path: "text/template"},
+	}, initImports)
+
+	specs := []string{}
+	for _, ispec := range merged {
+		specs = append(specs, ispec.String())
+	}
+
+	expected := []string{`"net/http"`, `"text/template"`, `"time"`,
+		`template_1 "html/template"`, `_ "image/png"`, `htmltemplate "html/template"`}
+	if strings.Join(specs, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Merged imports are %v instead of %v", specs, expected)
+	}
+
+	if len(aliased) != 1 || aliased[initImports[2]] != "template_1" {
+		t.Errorf("Unexpected aliases: %v", aliased)
+	}
+}
+
+func TestInitPageImportsAreMerged(t *testing.T) {
+	mkTestSite()
+	if noCleanup {
+		fmt.Println("tmpdir =", tmpdir)
+	} else {
+		defer rmTmpDir()
+	}
+
+	content := "\nimport (\n    \"bytes\"\n    \"net/http\"\n    \"html/template\"\n)\n\n" +
+		"import \"strings\"\n\n" +
+		"var buf bytes.Buffer\n" +
+		"\x0c\nctx[\"S\"] = strings.ToUpper(template.HTMLEscapeString(\"<b>\"))\n" +
+		"ctx[\"C\"] = http.StatusOK\n" +
+		"\x0c\n{{.S}} {{.C}}\n"
+
+	err := ioutil.WriteFile(path.Join(testWwwRoot, "imports.txt"), []byte(content), 0644)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	sb, err := newSiteBuilder(&SiteBuilderCfg{
+		WwwRoot:       testWwwRoot,
+		OutputGopath:  tmpdir,
+		GenServerBind: ":9182",
+		MkOutDir:      true,
+		TypeCheck:     true,
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = sb.Build()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	fileName := path.Join(aspenGoGenDir, "imports-DOT-txt.go")
+	f, err := parser.ParseFile(token.NewFileSet(), fileName, nil, 0)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	importDecls := 0
+	for _, decl := range f.Decls {
+		if gen, ok := decl.(*ast.GenDecl); ok && gen.Tok == token.IMPORT {
+			importDecls++
+		}
+	}
+
+	if importDecls != 1 {
+		t.Errorf("Generated source has %d import declarations", importDecls)
+	}
+
+	src, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !bytes.Contains(src, []byte("template_1.HTMLEscapeString(")) {
+		t.Errorf("Clashing import wasn't aliased:\n%s", src)
+	}
+}
+
+func TestSiteBuilderReportsEveryTypeError(t *testing.T) {
+	mkTestSite()
+	if noCleanup {
+		fmt.Println("tmpdir =", tmpdir)
+	} else {
+		defer rmTmpDir()
+	}
+
+	broken := map[string]string{
+		"broken/one.txt": "\x0c\nctx[\"D\"] = undefinedThing\n\x0c\n{{.D}}\n",
+		"broken/two.txt": "\x0c\nctx[\"D\"] = 1\nvar wat int = \"wat\"\n\x0c\n{{.D}}\n",
+	}
+
+	for filePath, content := range broken {
+		fullPath := path.Join(testWwwRoot, filePath)
+		err := os.MkdirAll(path.Dir(fullPath), os.ModeDir|os.ModePerm)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		err = ioutil.WriteFile(fullPath, []byte(content), 0644)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	sb, err := newSiteBuilder(&SiteBuilderCfg{
+		WwwRoot:       testWwwRoot,
+		OutputGopath:  tmpdir,
+		GenServerBind: ":9182",
+		MkOutDir:      true,
+		TypeCheck:     true,
+		Compile:       false,
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	errs, ok := sb.Build().(MultiError)
+	if !ok {
+		t.Errorf("Type errors were not reported as a MultiError")
+		return
+	}
+
+	found := map[string]int{}
+	for _, err := range errs {
+		serr, ok := err.(*SimplateError)
+		if !ok || serr.Code != SimplateErrorGoType {
+			continue
+		}
+
+		rel, _ := filepath.Rel(testWwwRoot, serr.Filename)
+		found[rel] = serr.Line
+		if serr.Page != 1 {
+			t.Errorf("Type error attributed to page %d instead of 1: %v", serr.Page, serr)
+		}
+	}
+
+	if found["broken/one.txt"] != 2 {
+		t.Errorf("Type error in broken/one.txt not reported at line 2: %v", errs)
+	}
+
+	if found["broken/two.txt"] != 3 {
+		t.Errorf("Type error in broken/two.txt not reported at line 3: %v", errs)
+	}
+}
+
+func TestFormattedSourcesMapBlankLinesToSimplate(t *testing.T) {
+	mkTestSite()
+	if noCleanup {
+		fmt.Println("tmpdir =", tmpdir)
+	} else {
+		defer rmTmpDir()
+	}
+
+	// formatting collapses the blank lines between the declaration and use
+	err := ioutil.WriteFile(path.Join(testWwwRoot, "blanks.txt"),
+		[]byte("\x0c\nx := 1\n\n\n\nctx[\"X\"] = undefinedThing + x\n\x0c\n{{.X}}\n"), 0644)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	sb, err := newSiteBuilder(&SiteBuilderCfg{
+		WwwRoot:       testWwwRoot,
+		OutputGopath:  tmpdir,
+		GenServerBind: ":9182",
+		MkOutDir:      true,
+		Format:        true,
+		TypeCheck:     true,
+		Compile:       false,
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	errs, ok := sb.Build().(MultiError)
+	if !ok {
+		t.Errorf("Type errors were not reported as a MultiError")
+		return
+	}
+
+	for _, err := range errs {
+		serr, ok := err.(*SimplateError)
+		if !ok || serr.Code != SimplateErrorGoType {
+			continue
+		}
+
+		if serr.Filename != path.Join(testWwwRoot, "blanks.txt") || serr.Line != 6 {
+			t.Errorf("Type error not reported at blanks.txt line 6: %v", serr)
+		}
+		return
+	}
+
+	t.Errorf("Type error in blanks.txt not reported: %v", errs)
+}
+
+func TestNewSiteBuilderCompilesSources(t *testing.T) {
+	mkTestSite()
+	if noCleanup {
+		fmt.Println("tmpdir =", tmpdir)
+	} else {
+		defer rmTmpDir()
+	}
+
+	sb, err := newSiteBuilder(&SiteBuilderCfg{
+		WwwRoot:       testWwwRoot,
+		OutputGopath:  tmpdir,
+		GenServerBind: ":9182",
+		Format:        true,
+		Compile:       true,
+		MkOutDir:      true,
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = sb.Build()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	serverBinary := path.Join(sb.OutputGopath, "bin", "aspen_go_gen-http-server")
+
+	fi, err := os.Stat(serverBinary)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if fi.Mode() != (os.FileMode)(0750) {
+		t.Errorf("Site server binary %q permissions != %v: %v",
+			serverBinary, (os.FileMode)(0750), fi.Mode())
+	}
+}
+
+// mkTestAspenCheckout makes a stand-in for a local aspen-go checkout with the
+// given module path, for generated modules to replace aspen-go with.
+func mkTestAspenCheckout(modulePath string) (string, error) {
+	checkout := path.Join(tmpdir, "aspen-go-checkout")
+	err := os.MkdirAll(checkout, os.ModeDir|os.ModePerm)
+	if err != nil {
+		return "", err
+	}
+
+	err = ioutil.WriteFile(path.Join(checkout, "go.mod"),
+		[]byte(fmt.Sprintf("module %s\n\ngo 1.16\n", modulePath)), 0644)
+	if err != nil {
+		return "", err
+	}
+
+	return checkout, ioutil.WriteFile(path.Join(checkout, "aspen.go"),
+		[]byte("package aspen\n"), 0644)
+}
+
+func TestSiteBuilderWritesModule(t *testing.T) {
+	mkTestSite()
+	if noCleanup {
+		fmt.Println("tmpdir =", tmpdir)
+	} else {
+		defer rmTmpDir()
+	}
+
+	aspenCheckout, err := mkTestAspenCheckout("github.com/zetaweb/aspen-go")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	moduleRoot := path.Join(tmpdir, "site-module")
+	cfg := &SiteBuilderCfg{
+		WwwRoot:       testWwwRoot,
+		OutputGopath:  moduleRoot,
+		GenServerBind: ":9182",
+		MkOutDir:      true,
+		ModuleMode:    true,
+		ModulePath:    "example.com/site",
+		AspenReplace:  aspenCheckout,
+		ServerBinary:  path.Join(tmpdir, "site-server"),
+	}
+
+	sb, err := newSiteBuilder(cfg)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if sb.ServerBinary != cfg.ServerBinary {
+		t.Errorf("Server binary is %q instead of %q", sb.ServerBinary, cfg.ServerBinary)
+	}
+
+	err = sb.Build()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	goMod, err := ioutil.ReadFile(path.Join(moduleRoot, "go.mod"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, expected := range []string{
+		"module example.com/site\n",
+		"\nreplace github.com/zetaweb/aspen-go => " + aspenCheckout + "\n",
+	} {
+		if !strings.Contains(string(goMod), expected) {
+			t.Errorf("Generated go.mod lacks %q:\n%s", expected, goMod)
+		}
+	}
+
+	_, err = os.Stat(path.Join(moduleRoot, "aspen_go_gen", "shill-SLASH-cans-DOT-txt.go"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	serverMain := path.Join(moduleRoot, "aspen_go_gen", "aspen_go_gen-http-server", "main.go")
+	f, err := parser.ParseFile(token.NewFileSet(), serverMain, nil, parser.ImportsOnly)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	imported := false
+	for _, spec := range f.Imports {
+		imported = imported || spec.Path.Value == `"example.com/site/aspen_go_gen"`
+	}
+
+	if !imported {
+		t.Errorf("Generated server doesn't import the generated package by module path")
+	}
+
+	// requirements recorded by the go tool must survive a rebuild
+	tidied := string(goMod) + "\nrequire github.com/yuin/goldmark v1.4.0\n"
+	err = ioutil.WriteFile(path.Join(moduleRoot, "go.mod"), []byte(tidied), 0644)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	sb, err = newSiteBuilder(cfg)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = sb.Build()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	goMod, err = ioutil.ReadFile(path.Join(moduleRoot, "go.mod"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if string(goMod) != tidied {
+		t.Errorf("Existing go.mod was rewritten:\n%s", goMod)
+	}
+}
+
+func TestNewSiteBuilderDefaultsAspenImportPath(t *testing.T) {
+	sb, err := newSiteBuilder(&SiteBuilderCfg{
+		WwwRoot:       ".",
+		OutputGopath:  ".",
+		GenServerBind: ":9182",
+	})
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if sb.AspenImportPath != "github.com/zetaweb/aspen-go" {
+		t.Errorf("Aspen import path default != \"github.com/zetaweb/aspen-go\": %q",
+			sb.AspenImportPath)
+	}
+}
+
+func TestSiteBuilderUsesAspenImportPath(t *testing.T) {
+	mkTestSite()
+	if noCleanup {
+		fmt.Println("tmpdir =", tmpdir)
+	} else {
+		defer rmTmpDir()
+	}
+
+	aspenCheckout, err := mkTestAspenCheckout("example.com/forks/aspen-go")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	moduleRoot := path.Join(tmpdir, "site-module")
+	sb, err := newSiteBuilder(&SiteBuilderCfg{
+		WwwRoot:         testWwwRoot,
+		OutputGopath:    moduleRoot,
+		GenServerBind:   ":9182",
+		MkOutDir:        true,
+		ModuleMode:      true,
+		ModulePath:      "example.com/site",
+		AspenReplace:    aspenCheckout,
+		AspenImportPath: "example.com/forks/aspen-go",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = sb.Build()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	goMod, err := ioutil.ReadFile(path.Join(moduleRoot, "go.mod"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	expected := "\nreplace example.com/forks/aspen-go => " + aspenCheckout + "\n"
+	if !strings.Contains(string(goMod), expected) {
+		t.Errorf("Generated go.mod lacks %q:\n%s", expected, goMod)
+	}
+
+	for _, generated := range []string{
+		path.Join(moduleRoot, "aspen_go_gen", "shill-SLASH-cans-DOT-txt.go"),
+		path.Join(moduleRoot, "aspen_go_gen", "aspen_go_gen-http-server", "main.go"),
+	} {
+		f, err := parser.ParseFile(token.NewFileSet(), generated, nil, parser.ImportsOnly)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		for _, spec := range f.Imports {
+			if spec.Path.Value == `"github.com/zetaweb/aspen-go"` {
+				t.Errorf("%q imports the default aspen-go import path", generated)
+			}
+		}
+	}
+}
+
+func TestSiteBuilderRejectsUnresolvableAspenImportPath(t *testing.T) {
+	mkTestSite()
+	if noCleanup {
+		fmt.Println("tmpdir =", tmpdir)
+	} else {
+		defer rmTmpDir()
+	}
+
+	sb, err := newSiteBuilder(&SiteBuilderCfg{
+		WwwRoot:         testWwwRoot,
+		OutputGopath:    tmpdir,
+		GenServerBind:   ":9182",
+		MkOutDir:        true,
+		AspenImportPath: "example.com/no/such/aspen-go",
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = sb.Build()
+	if err == nil {
+		t.Errorf("Unresolvable aspen-go import path was accepted")
+		return
+	}
+
+	if !strings.Contains(err.Error(), "example.com/no/such/aspen-go") {
+		t.Errorf("Error doesn't name the aspen-go import path: %v", err)
+	}
+}
+
+func TestStaticHandlerServesFromStaticFS(t *testing.T) {
+	w := &Website{
+		WwwRoot:  "/nonexistent",
+		ListDirs: true,
+		Indices:  []string{"index.html"},
+	}
+	w.SetStaticFS(fstest.MapFS{
+		"shill/cans.txt":   &fstest.MapFile{Data: []byte("cans")},
+		"shill/.hidden":    &fstest.MapFile{Data: []byte("psst")},
+		"hat/index.html":   &fstest.MapFile{Data: []byte("<p>hat</p>")},
+		"hams/bone/marrow": &fstest.MapFile{Data: []byte("marrow")},
+	})
+
+	sh := &websiteStaticHandler{w: w}
+
+	for requestPath, expected := range map[string]string{
+		"/shill/cans.txt": "cans",
+		"/hat/":           "<p>hat</p>",
+	} {
+		rec := httptest.NewRecorder()
+		sh.ServeHTTP(rec, httptest.NewRequest("GET", requestPath, nil))
+		if rec.Code != http.StatusOK || rec.Body.String() != expected {
+			t.Errorf("Request for %q got %d %q instead of %q",
+				requestPath, rec.Code, rec.Body.String(), expected)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	sh.ServeHTTP(rec, httptest.NewRequest("GET", "/shill/.hidden", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Request for ignored file got status %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	sh.ServeHTTP(rec, httptest.NewRequest("GET", "/hams/bone/", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "marrow") {
+		t.Errorf("Directory listing got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+// mkTestSiteArchive writes the test site files into an archive in tmpdir,
+// of the kind given by the archive name's extension.
+func mkTestSiteArchive(name string) string {
+	mkTmpDir()
+
+	archivePath := path.Join(tmpdir, name)
+	f, err := os.Create(archivePath)
+	if err != nil {
+		panic(err)
+	}
+
+	defer f.Close()
+
+	if strings.HasSuffix(name, ".zip") {
+		zw := zip.NewWriter(f)
+		for filePath, content := range testSiteFiles {
+			w, err := zw.Create(filePath)
+			if err != nil {
+				panic(err)
+			}
+
+			_, err = w.Write([]byte(content))
+			if err != nil {
+				panic(err)
+			}
+		}
+
+		err = zw.Close()
+		if err != nil {
+			panic(err)
+		}
+
+		return archivePath
+	}
+
+	gzw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gzw)
+	for filePath, content := range testSiteFiles {
+		err = tw.WriteHeader(&tar.Header{
+			Name:    "./" + filePath,
+			Mode:    0644,
+			Size:    int64(len(content)),
+			ModTime: time.Now(),
+		})
+		if err != nil {
+			panic(err)
+		}
+
+		_, err = tw.Write([]byte(content))
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	err = tw.Close()
+	if err != nil {
+		panic(err)
+	}
+
+	err = gzw.Close()
+	if err != nil {
+		panic(err)
+	}
+
+	return archivePath
+}
+
+func TestTreeWalkerWalksArchives(t *testing.T) {
+	if noCleanup {
+		fmt.Println("tmpdir =", tmpdir)
+	} else {
+		defer rmTmpDir()
+	}
+
+	for _, name := range []string{"test-site.zip", "test-site.tar.gz"} {
+		tw, err := newTreeWalker("aspen_go_gen", mkTestSiteArchive(name))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		simplates, err := tw.Simplates()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if len(simplates) != len(testSiteFiles) {
+			t.Errorf("Walking %q yielded unexpected number of files: %v",
+				name, len(simplates))
+		}
+
+		for _, simplate := range simplates {
+			if _, ok := testSiteFiles[filepath.ToSlash(simplate.Filename)]; !ok {
+				t.Errorf("Walking %q yielded unexpected file %q", name, simplate.Filename)
+			}
+		}
+	}
+}
+
+func TestTarArchiveIsAValidFS(t *testing.T) {
+	if noCleanup {
+		fmt.Println("tmpdir =", tmpdir)
+	} else {
+		defer rmTmpDir()
+	}
+
+	fsys, err := OpenWwwFS(mkTestSiteArchive("test-site.tar.gz"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	expected := []string{}
+	for filePath := range testSiteFiles {
+		expected = append(expected, filePath)
+	}
+
+	err = fstest.TestFS(fsys, expected...)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTreeWalkerWalksMapFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		".aspenignore":   &fstest.MapFile{Data: []byte("drafts/\n")},
+		"shill/cans.txt": &fstest.MapFile{Data: []byte(basicRenderedTxtSimplate)},
+		"hat/v.json":     &fstest.MapFile{Data: []byte(basicJsonSimplate)},
+		"drafts/wip.txt": &fstest.MapFile{Data: []byte(basicRenderedTxtSimplate)},
+		"logo.png":       &fstest.MapFile{Data: []byte("\x89PNG\r\n\x1a\n")},
+	}
+
+	tw, err := newTreeWalkerFS("aspen_go_gen", "/srv/www", fsys)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	simplates, err := tw.Simplates()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	types := map[string]string{}
+	for _, simplate := range simplates {
+		types[filepath.ToSlash(simplate.Filename)] = simplate.Type
+
+		if simplate.AbsFilename != filepath.Join("/srv/www", simplate.Filename) {
+			t.Errorf("Simplate %q has unexpected absolute filename %q",
+				simplate.Filename, simplate.AbsFilename)
+		}
+	}
+
+	expected := map[string]string{
+		"shill/cans.txt": SimplateTypeRendered,
+		"hat/v.json":     SimplateTypeJson,
+		"logo.png":       SimplateTypeStatic,
+	}
+
+	if len(types) != len(expected) {
+		t.Errorf("Tree walking yielded unexpected files: %v", types)
+	}
+
+	for filename, simplateType := range expected {
+		if types[filename] != simplateType {
+			t.Errorf("%q was walked as %q instead of %q", filename, types[filename], simplateType)
+		}
+	}
+}
+
+func TestWebsiteServesStaticFilesFromArchive(t *testing.T) {
+	if noCleanup {
+		fmt.Println("tmpdir =", tmpdir)
+	} else {
+		defer rmTmpDir()
+	}
+
+	for _, name := range []string{"test-site.zip", "test-site.tar.gz"} {
+		w := &Website{}
+		w.Configure(":9182", mkTestSiteArchive(name), "utf-8", "utf-8",
+			"index.html", false, false)
+
+		if w.StaticFS == nil {
+			t.Errorf("Configuring archive %q as www root didn't set a static FS", name)
+			continue
+		}
+
+		rec := httptest.NewRecorder()
+		sh := &websiteStaticHandler{w: w}
+		sh.ServeHTTP(rec, httptest.NewRequest("GET", "/Big%20CMS/Owns_UR%20Contents/flurb.txt", nil))
+		if rec.Code != http.StatusOK || rec.Body.String() != basicStaticTxtSimplate {
+			t.Errorf("Serving from %q got %d %q", name, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestSiteBuilderBuildsFromFS(t *testing.T) {
+	mkTmpDir()
+	if noCleanup {
+		fmt.Println("tmpdir =", tmpdir)
+	} else {
+		defer rmTmpDir()
+	}
+
+	fsys := fstest.MapFS{}
+	for filePath, content := range testSiteFiles {
+		fsys[filePath] = &fstest.MapFile{Data: []byte(content)}
+	}
+
+	sb, err := newSiteBuilder(&SiteBuilderCfg{
+		WwwRoot:       path.Join(tmpdir, "no-such-site"),
+		WwwFS:         fsys,
+		OutputGopath:  tmpdir,
+		GenServerBind: ":9182",
+		MkOutDir:      true,
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = sb.Build()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = os.Stat(path.Join(aspenGoGenDir, "shill-SLASH-cans-DOT-txt.go"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	_, err = os.Stat(path.Join(aspenGoGenDir, SiteIndexFilename))
+	if err != nil {
+		t.Errorf("Site index wasn't kept with the generated package: %v", err)
+	}
+}
+
+func TestSiteBuilderEmbedsStaticFiles(t *testing.T) {
+	mkTestSite()
+	if noCleanup {
+		fmt.Println("tmpdir =", tmpdir)
+	} else {
+		defer rmTmpDir()
+	}
+
+	cfg := &SiteBuilderCfg{
+		WwwRoot:       testWwwRoot,
+		OutputGopath:  tmpdir,
+		GenServerBind: ":9182",
+		MkOutDir:      true,
+		TypeCheck:     true,
+		EmbedStatic:   true,
+	}
+
+	sb, err := newSiteBuilder(cfg)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = sb.Build()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	embedded := path.Join(aspenGoGenDir, "aspen_static", "Big CMS", "Owns_UR Contents", "flurb.txt")
+	content, err := ioutil.ReadFile(embedded)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if string(content) != basicStaticTxtSimplate {
+		t.Errorf("Embedded static file has unexpected content: %q", content)
+	}
+
+	_, err = os.Stat(path.Join(aspenGoGenDir, "aspen_static", "shill", "cans.txt"))
+	if !os.IsNotExist(err) {
+		t.Errorf("Rendered simplate was copied for embedding: %v", err)
+	}
+
+	embedSource, err := ioutil.ReadFile(path.Join(aspenGoGenDir, "aspen-static-embed.go"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !strings.Contains(string(embedSource), "//go:embed aspen_static\n") {
+		t.Errorf("Embed source lacks a go:embed directive:\n%s", embedSource)
+	}
+
+	// files removed from the www root are removed from the embedded files
+	err = os.Remove(path.Join(testWwwRoot, "Big CMS", "Owns_UR Contents", "flurb.txt"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	sb, err = newSiteBuilder(cfg)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = sb.Build()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = os.Stat(path.Join(aspenGoGenDir, "aspen_static", "Big CMS"))
+	if !os.IsNotExist(err) {
+		t.Errorf("Removed static file is still embedded: %v", err)
+	}
+
+	cfg.EmbedStatic = false
+	sb, err = newSiteBuilder(cfg)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = sb.Build()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, leftover := range []string{"aspen_static", "aspen-static-embed.go"} {
+		_, err = os.Stat(path.Join(aspenGoGenDir, leftover))
+		if !os.IsNotExist(err) {
+			t.Errorf("%q was left behind without embedding: %v", leftover, err)
+		}
+	}
+}
+
+func benchmarkSiteBuilderWriteSources(b *testing.B, jobs int) {
+	mkLargeTestSite(200)
+	if noCleanup {
+		fmt.Println("tmpdir =", tmpdir)
+	} else {
+		defer rmTmpDir()
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		sb, err := newSiteBuilder(&SiteBuilderCfg{
+			WwwRoot:       testWwwRoot,
+			OutputGopath:  tmpdir,
+			GenServerBind: ":9182",
+			MkOutDir:      true,
+			Jobs:          jobs,
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		err = sb.writeSources()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSiteBuilderWriteSourcesOneJob(b *testing.B) {
+	benchmarkSiteBuilderWriteSources(b, 1)
+}
+
+func BenchmarkSiteBuilderWriteSourcesDefaultJobs(b *testing.B) {
+	benchmarkSiteBuilderWriteSources(b, DefaultJobs)
 }
@@ -1,12 +1,20 @@
 package aspen
 
 import (
+	"bytes"
+	"crypto/sha1"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"go/build"
+	"io/fs"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"strings"
 	"text/template"
 )
@@ -15,14 +23,20 @@ var (
 	SiteIndexFilename   = ".aspen-go-index.json"
 	DefaultGenPackage   = "aspen_go_gen"
 	DefaultOutputGopath = ""
-	genServerTemplate   = template.Must(template.New("aspen-genserver").Parse(`
+	genGoModGoVersion   = "1.16"
+
+	// DefaultAspenImportPath is the import path of aspen-go in generated
+	// sources, unless another is configured: that of the builder itself.
+	DefaultAspenImportPath = reflect.TypeOf(siteBuilder{}).PkgPath()
+
+	genServerTemplate = template.Must(template.New("aspen-genserver").Parse(`
 package main
 // GENERATED FILE - DO NOT EDIT
 // Rebuild with aspen-build!
 
 import (
-    "github.com/zetaweb/aspen-go"
-    _ "{{.GenPackage}}"
+    aspen "{{.AspenImportPath}}"
+    _ "{{.GenPackageImport}}"
 )
 
 func main() {
@@ -48,23 +62,71 @@ type siteBuilder struct {
 	// used primarily for compile time
 	OutputGopath string
 	Format       bool
+	TypeCheck    bool
 	Compile      bool
+	Jobs         int
+
+	// module mode writes a module rooted at OutputGopath instead of using
+	// OutputGopath as a GOPATH entry
+	ModuleMode   bool
+	ModulePath   string
+	AspenReplace string
+	ServerBinary string
+	EmbedStatic  bool
+	LibDir       string
+	// import path of aspen-go in generated sources
+	AspenImportPath string
 
 	goexe       string
 	walker      *treeWalker
+	srcRoot     string
 	packagePath string
+	indexPath   string
 	genServer   string
 	index       *siteIndex
+	prevIndex   *siteIndex
+	summary     *buildSummary
+	simplates   map[string]*simplate
 }
 
 type SiteBuilderCfg struct {
-	WwwRoot       string
+	// a www root directory, or a zip or tar archive of one
+	WwwRoot string
+	// if set, walked and read in place of WwwRoot, which then only names the
+	// simplates' files in generated sources and errors
+	WwwFS         fs.FS
 	OutputGopath  string
 	GenPackage    string
 	GenServerBind string
 	Format        bool
 	MkOutDir      bool
+	TypeCheck     bool
 	Compile       bool
+	// glob patterns of www root paths that are always served as static files
+	StaticPaths []string
+	// number of simplates parsed and generated at once; DefaultJobs when
+	// less than 1
+	Jobs int
+
+	// ModuleMode writes the generated package and server into a Go module
+	// rooted at OutputGopath, with module path ModulePath (GenPackage by
+	// default).  AspenReplace, if given, is the directory of a local aspen-go
+	// checkout used in place of the published module.
+	ModuleMode   bool
+	ModulePath   string
+	AspenReplace string
+	// where the compiled server binary is written; by default
+	// OutputGopath/bin/<GenPackage>-http-server
+	ServerBinary string
+	// copy static files into the generated package and embed them in the
+	// server, which then serves them without the www root
+	EmbedStatic bool
+	// directory of the www root whose .go files are built into the generated
+	// package for every simplate to use; DefaultLibDir if empty
+	LibDir string
+	// import path of aspen-go, e.g. of a fork, in generated sources;
+	// DefaultAspenImportPath if empty
+	AspenImportPath string
 
 	CharsetStatic  string
 	CharsetDynamic string
@@ -74,13 +136,27 @@ type SiteBuilderCfg struct {
 }
 
 type siteIndex struct {
-	WwwRoot   string                      `json:"root_dir"`
+	WwwRoot string `json:"root_dir"`
+	// fingerprint of the builder that generated the indexed sources
+	Builder   string                      `json:"builder"`
 	Simplates map[string]*simplateSummary `json:"simplates"`
 }
 
 type simplateSummary struct {
 	Type        string `json:"type"`
 	ContentType string `json:"content_type"`
+	Hash        string `json:"hash"`
+	// generated source, relative to the generated package, if any
+	Output string `json:"output,omitempty"`
+}
+
+// buildSummary lists the request paths of simplates by how they changed since
+// the previous build.
+type buildSummary struct {
+	Added     []string
+	Changed   []string
+	Removed   []string
+	Unchanged []string
 }
 
 func init() {
@@ -108,13 +184,40 @@ func newSiteBuilder(cfg *SiteBuilderCfg) (*siteBuilder, error) {
 		genPkg = DefaultGenPackage
 	}
 
-	if cfg.Compile || cfg.Format {
-		goexe, err = exec.LookPath("go")
+	modulePath := cfg.ModulePath
+	if len(modulePath) == 0 {
+		modulePath = genPkg
+	}
+
+	aspenReplace := cfg.AspenReplace
+	if len(aspenReplace) > 0 {
+		aspenReplace, err = filepath.Abs(aspenReplace)
 		if err != nil {
 			return nil, err
 		}
 	}
 
+	serverBinary := cfg.ServerBinary
+	if len(serverBinary) == 0 {
+		serverBinary = DefaultServerBinary(outPath, genPkg)
+	}
+
+	serverBinary, err = filepath.Abs(serverBinary)
+	if err != nil {
+		return nil, err
+	}
+
+	srcRoot := path.Join(outPath, "src")
+	if cfg.ModuleMode {
+		srcRoot = outPath
+	}
+
+	// every build resolves the aspen-go import path with the go tool
+	goexe, err = exec.LookPath("go")
+	if err != nil {
+		return nil, err
+	}
+
 	if cfg.MkOutDir {
 		err = os.MkdirAll(outPath, os.ModeDir|(os.FileMode)(0755))
 		if err != nil {
@@ -132,18 +235,60 @@ func newSiteBuilder(cfg *SiteBuilderCfg) (*siteBuilder, error) {
 	}
 
 	debugf("Creating new tree walker with package name %q, root dir %q", genPkg, rootDir)
-	walker, err := newTreeWalker(genPkg, rootDir)
+	var walker *treeWalker
+	if cfg.WwwFS != nil {
+		walker, err = newTreeWalkerFS(genPkg, rootDir, cfg.WwwFS)
+	} else {
+		walker, err = newTreeWalker(genPkg, rootDir)
+	}
 	if err != nil {
 		return nil, err
 	}
 
+	packagePath := path.Join(srcRoot, genPkg)
+
+	// the index is kept in the www root unless it isn't a writable directory
+	indexPath := path.Join(rootDir, SiteIndexFilename)
+	if cfg.WwwFS != nil || isArchive(rootDir) {
+		indexPath = path.Join(packagePath, SiteIndexFilename)
+	}
+
+	walker.StaticPaths = cfg.StaticPaths
+	walker.Jobs = cfg.Jobs
+
+	libDir := DefaultLibDir
+	if len(cfg.LibDir) > 0 {
+		libDir = strings.Trim(path.Clean("/"+filepath.ToSlash(cfg.LibDir)), "/")
+		if len(libDir) == 0 {
+			return nil, fmt.Errorf("Invalid library directory %q!", cfg.LibDir)
+		}
+	}
+
+	walker.LibDir = libDir
+
+	aspenImportPath := cfg.AspenImportPath
+	if len(aspenImportPath) == 0 {
+		aspenImportPath = DefaultAspenImportPath
+	}
+
 	sb := &siteBuilder{
 		WwwRoot:       rootDir,
 		OutputGopath:  outPath,
 		GenPackage:    genPkg,
 		GenServerBind: cfg.GenServerBind,
 		Format:        cfg.Format,
+		TypeCheck:     cfg.TypeCheck,
 		Compile:       cfg.Compile,
+		Jobs:          cfg.Jobs,
+
+		ModuleMode:   cfg.ModuleMode,
+		ModulePath:   modulePath,
+		AspenReplace: aspenReplace,
+		ServerBinary: serverBinary,
+		EmbedStatic:  cfg.EmbedStatic,
+		LibDir:       libDir,
+
+		AspenImportPath: aspenImportPath,
 
 		CharsetDynamic: cfg.CharsetDynamic,
 		CharsetStatic:  cfg.CharsetStatic,
@@ -153,14 +298,20 @@ func newSiteBuilder(cfg *SiteBuilderCfg) (*siteBuilder, error) {
 
 		goexe:       goexe,
 		walker:      walker,
-		packagePath: path.Join(outPath, "src", genPkg),
+		srcRoot:     srcRoot,
+		packagePath: packagePath,
+		indexPath:   indexPath,
 		genServer:   fmt.Sprintf("%s/%s-http-server", genPkg, genPkg),
 		index: &siteIndex{
 			WwwRoot:   rootDir,
 			Simplates: map[string]*simplateSummary{},
 		},
+		summary:   &buildSummary{},
+		simplates: map[string]*simplate{},
 	}
 
+	sb.index.Builder = sb.builderFingerprint()
+
 	debugf("Initialized site builder: %+v from cfg %+v", sb, cfg)
 
 	return sb, nil
@@ -185,19 +336,23 @@ func (me *siteBuilder) writeOneSource(simplate *simplate) error {
 		}
 	}
 
-	outf, err := os.Create(outname)
-	if err != nil {
-		return err
-	}
-
 	debugf(" --> Executing simplate for %v\n", simplate.Filename)
-	err = simplate.Execute(outf)
+	var srcBuf bytes.Buffer
+	err = simplate.Execute(&srcBuf)
 	if err != nil {
 		return err
 	}
 	debugf(" --> Done executing simplate for %v\n", simplate.Filename)
 
-	err = outf.Close()
+	src := srcBuf.Bytes()
+	if me.Format {
+		src, err = simplate.formatSource(src)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = ioutil.WriteFile(outname, src, 0644)
 	if err != nil {
 		return err
 	}
@@ -207,7 +362,7 @@ func (me *siteBuilder) writeOneSource(simplate *simplate) error {
 }
 
 func (me *siteBuilder) writeGenServer() error {
-	dirname := path.Join(me.OutputGopath, "src", me.genServer)
+	dirname := path.Join(me.srcRoot, me.genServer)
 	err := os.MkdirAll(dirname, os.ModeDir|(os.FileMode)(0755))
 	if err != nil {
 		return err
@@ -234,28 +389,61 @@ func (me *siteBuilder) writeGenServer() error {
 func (me *siteBuilder) writeSources() error {
 	debugf("Site builder writing sources")
 
-	simplates, err := me.walker.Simplates()
+	all, walkErr := me.walker.Simplates()
+	for _, simplate := range all {
+		simplate.AspenImportPath = me.AspenImportPath
+		me.simplates[simplate.AbsFilename] = simplate
+	}
+
+	// refuse to write a package that would panic while initializing, and
+	// report broken templates along with any simplates that failed to parse
+	errs := MultiError{}
+	if walkErr != nil {
+		errs = append(errs, walkErr.(MultiError)...)
+	}
+
+	err := me.validateTemplates(all)
 	if err != nil {
-		return err
+		errs = append(errs, err.(MultiError)...)
 	}
 
-	for simplate := range simplates {
-		if simplate == nil {
-			// assume `walker.Simplates()` assigned error to same address
-			// as one above?
-			return err
+	nameErrs, nameWarnings := checkOutputNames(all)
+	errs = append(errs, nameErrs...)
+	for _, warning := range nameWarnings {
+		fmt.Fprintf(os.Stderr, "WARNING: %v\n", warning)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	me.loadPrevSiteIndex()
+
+	stale := []*simplate{}
+	for _, simplate := range all {
+		if me.isStale(simplate) {
+			stale = append(stale, simplate)
 		}
+	}
 
+	errs = runJobs(me.Jobs, len(stale), func(i int) error {
 		debugf("Site builder about to write source for %v simplate %q",
-			simplate.Type, simplate.Filename)
-		err := me.writeOneSource(simplate)
-		if err != nil {
-			return err
-		}
+			stale[i].Type, stale[i].Filename)
+		return me.writeOneSource(stale[i])
+	})
+	if len(errs) > 0 {
+		return errs
+	}
 
+	for _, simplate := range all {
 		me.indexSimplate(simplate)
 	}
 
+	err = me.removeStaleSources()
+	if err != nil {
+		return err
+	}
+
 	err = me.dumpSiteIndex()
 	if err != nil {
 		return err
@@ -266,22 +454,226 @@ func (me *siteBuilder) writeSources() error {
 		return err
 	}
 
+	err = me.writeStaticEmbed(all)
+	if err != nil {
+		return err
+	}
+
+	err = me.writeLibSources()
+	if err != nil {
+		return err
+	}
+
+	if me.ModuleMode {
+		err = me.writeGoMod()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (me *siteBuilder) validateTemplates(simplates []*simplate) error {
+	debugf("Site builder validating templates")
+	errs := MultiError{}
+
+	for _, err := range runJobs(me.Jobs, len(simplates), func(i int) error {
+		return simplates[i].ValidateTemplates()
+	}) {
+		errs = append(errs, err.(MultiError)...)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
 	return nil
 }
 
 func (me *siteBuilder) indexSimplate(simplate *simplate) {
-	me.index.Simplates[fmt.Sprintf("/%v", simplate.Filename)] = &simplateSummary{
+	summary := &simplateSummary{
 		Type:        simplate.Type,
 		ContentType: simplate.ContentType,
+		Hash:        simplate.Hash,
 	}
+
+	if simplate.Type != SimplateTypeStatic {
+		summary.Output = simplate.OutputName()
+	}
+
+	me.index.Simplates[simplate.RequestPath()] = summary
+}
+
+// builderFingerprint identifies everything besides simplate sources that goes
+// into the generated code, so that a change to any of it regenerates every
+// simplate.
+func (me *siteBuilder) builderFingerprint() string {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%v\x00%s\x00%s\x00", me.GenPackage, me.packagePath,
+		me.Format, me.GenPackageImport(), me.AspenImportPath)
+
+	for _, tmpl := range []string{simplateTypeRenderedTmpl,
+		simplateTypeJSONTmpl, simplateTypeNegotiatedTmpl} {
+		fmt.Fprintf(h, "%s\x00", tmpl)
+	}
+
+	for _, name := range RendererNames() {
+		fmt.Fprintf(h, "%s\x00%T\x00", name, renderers[name])
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// checkOutputNames reports every simplate whose generated source would share
+// a name with that of an earlier one.  Names differing only in case are fine
+// on case-sensitive file systems, but collide on case-insensitive ones, so
+// they're reported separately as warnings.
+func checkOutputNames(simplates []*simplate) (errs, warnings MultiError) {
+	errs = MultiError{}
+	warnings = MultiError{}
+	seen := map[string]*simplate{}
+	seenFolded := map[string]*simplate{}
+
+	for _, simplate := range simplates {
+		if simplate.Type == SimplateTypeStatic {
+			continue
+		}
+
+		name := simplate.OutputName()
+		if prev, ok := seen[name]; ok {
+			errs = append(errs, newSimplateError(simplate.AbsFilename, -1, 0, 0,
+				SimplateErrorNameCollision,
+				"Generated source %q collides with that of %q!", name, prev.Filename))
+			continue
+		}
+
+		seen[name] = simplate
+
+		folded := strings.ToLower(name)
+		if prev, ok := seenFolded[folded]; ok {
+			warnings = append(warnings, newSimplateError(simplate.AbsFilename, -1, 0, 0,
+				SimplateErrorNameCollision,
+				"Generated source %q differs only in case from that of %q, "+
+					"so they collide on case-insensitive file systems",
+				name, prev.Filename))
+			continue
+		}
+
+		seenFolded[folded] = simplate
+	}
+
+	return errs, warnings
+}
+
+// loadPrevSiteIndex reads the index left by the previous build.  A missing or
+// unreadable index, or one written by a different builder, makes every
+// simplate stale.
+func (me *siteBuilder) loadPrevSiteIndex() {
+	me.prevIndex = &siteIndex{Simplates: map[string]*simplateSummary{}}
+
+	encoded, err := ioutil.ReadFile(me.indexPath)
+	if err != nil {
+		debugf("Site builder found no previous site index: %v", err)
+		return
+	}
+
+	prevIndex := &siteIndex{}
+	err = json.Unmarshal(encoded, prevIndex)
+	if err != nil || prevIndex.Simplates == nil {
+		debugf("Site builder ignoring unreadable site index: %v", err)
+		return
+	}
+
+	me.prevIndex = prevIndex
+}
+
+// isStale reports whether the simplate's generated source must be written,
+// recording how the simplate changed in the build summary.
+func (me *siteBuilder) isStale(simplate *simplate) bool {
+	requestPath := simplate.RequestPath()
+
+	prev, ok := me.prevIndex.Simplates[requestPath]
+	if !ok {
+		me.summary.Added = append(me.summary.Added, requestPath)
+		return true
+	}
+
+	stale := prev.Hash != simplate.Hash || prev.Type != simplate.Type ||
+		me.prevIndex.Builder != me.index.Builder
+
+	if !stale && simplate.Type != SimplateTypeStatic {
+		_, err := os.Stat(path.Join(me.packagePath, simplate.OutputName()))
+		stale = err != nil
+	}
+
+	if stale {
+		me.summary.Changed = append(me.summary.Changed, requestPath)
+	} else {
+		me.summary.Unchanged = append(me.summary.Unchanged, requestPath)
+	}
+
+	return stale
+}
+
+// removeStaleSources deletes generated sources left behind by simplates that
+// have been removed, or that no longer generate code, since the previous
+// build.
+func (me *siteBuilder) removeStaleSources() error {
+	outputs := map[string]bool{}
+	for _, summary := range me.index.Simplates {
+		outputs[summary.Output] = true
+	}
+
+	requestPaths := []string{}
+	for requestPath, _ := range me.prevIndex.Simplates {
+		requestPaths = append(requestPaths, requestPath)
+	}
+
+	sort.Strings(requestPaths)
+
+	for _, requestPath := range requestPaths {
+		if _, ok := me.index.Simplates[requestPath]; !ok {
+			me.summary.Removed = append(me.summary.Removed, requestPath)
+		}
+
+		output := me.prevIndex.Simplates[requestPath].Output
+		if len(output) == 0 || outputs[output] {
+			continue
+		}
+
+		// outputs come from a file we don't control, so refuse any that
+		// would reach outside the generated package
+		outPath := filepath.Join(me.packagePath, filepath.FromSlash(output))
+		if filepath.Dir(outPath) != filepath.Clean(me.packagePath) {
+			debugf("Site builder ignoring suspicious output %q", output)
+			continue
+		}
+
+		debugf("Site builder removing stale source %q", outPath)
+		err := os.Remove(outPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (me *buildSummary) String() string {
+	return fmt.Sprintf("%d added, %d changed, %d removed, %d unchanged",
+		len(me.Added), len(me.Changed), len(me.Removed), len(me.Unchanged))
 }
 
 func (me *siteBuilder) dumpSiteIndex() error {
-	idxPath := path.Join(me.WwwRoot, SiteIndexFilename)
+	debugf("Site builder dumping site index to %q", me.indexPath)
 
-	debugf("Site builder dumping site index to %q", idxPath)
+	err := os.MkdirAll(path.Dir(me.indexPath), os.ModeDir|(os.FileMode)(0755))
+	if err != nil {
+		return err
+	}
 
-	out, err := os.Create(idxPath)
+	out, err := os.Create(me.indexPath)
 	if err != nil {
 		return err
 	}
@@ -306,70 +698,139 @@ func (me *siteBuilder) dumpSiteIndex() error {
 
 func (me *siteBuilder) compileSources() error {
 	debugf("Site builder compiling sources")
-	origGopath := os.Getenv("GOPATH")
-	err := os.Setenv("GOPATH", fmt.Sprintf("%s:%s", me.OutputGopath, origGopath))
-	if err != nil {
-		return err
-	}
 
-	defer os.Setenv("GOPATH", origGopath)
+	buildCmd := me.goCommand("build", "-o", me.ServerBinary, me.genServer)
+	if me.ModuleMode {
+		buildCmd = me.goCommand("build", "-mod=mod", "-o", me.ServerBinary,
+			"./"+me.genServer)
+	}
 
-	installPkgCmd := exec.Command(me.goexe, "install", me.GenPackage)
-	installPkgCmd.Stdout = os.Stdout
-	installPkgCmd.Stderr = os.Stderr
+	return buildCmd.Run()
+}
 
-	err = installPkgCmd.Run()
-	if err != nil {
-		return err
+// goCommand makes a go tool command that runs against the generated sources,
+// in module mode from the module root, and otherwise with OutputGopath at the
+// front of GOPATH.
+func (me *siteBuilder) goCommand(args ...string) *exec.Cmd {
+	cmd := exec.Command(me.goexe, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = os.Environ()
+
+	if me.ModuleMode {
+		cmd.Dir = me.OutputGopath
+		cmd.Env = append(cmd.Env, "GO111MODULE=on")
+	} else {
+		cmd.Env = append(cmd.Env, "GO111MODULE=off", fmt.Sprintf("GOPATH=%s%c%s",
+			me.OutputGopath, os.PathListSeparator, os.Getenv("GOPATH")))
 	}
 
-	installBinCmd := exec.Command(me.goexe, "install", me.genServer)
-	installBinCmd.Stdout = os.Stdout
-	installPkgCmd.Stderr = os.Stderr
+	return cmd
+}
 
-	err = installBinCmd.Run()
-	if err != nil {
-		return err
+// writeGoMod writes the go.mod of the generated module, unless one with the
+// same module path and aspen-go replacement exists, since "go build -mod=mod"
+// records the module's requirements there.
+func (me *siteBuilder) writeGoMod() error {
+	goMod := path.Join(me.OutputGopath, "go.mod")
+	moduleLine := fmt.Sprintf("module %s\n", me.ModulePath)
+	replaceLine := ""
+	if len(me.AspenReplace) > 0 {
+		replaceLine = fmt.Sprintf("replace %s => %s\n", me.AspenImportPath, me.AspenReplace)
+	}
+
+	existing, err := ioutil.ReadFile(goMod)
+	if err == nil && strings.HasPrefix(string(existing), moduleLine) {
+		hasReplace := strings.Contains(string(existing), "\nreplace ")
+		if (len(replaceLine) == 0 && !hasReplace) ||
+			(len(replaceLine) > 0 && strings.Contains(string(existing), "\n"+replaceLine)) {
+			debugf("Site builder keeping existing %q", goMod)
+			return nil
+		}
 	}
 
-	return nil
+	content := moduleLine + fmt.Sprintf("\ngo %s\n", genGoModGoVersion)
+	if len(replaceLine) > 0 {
+		content += fmt.Sprintf("\nrequire %s v0.0.0\n\n%s", me.AspenImportPath, replaceLine)
+	}
+
+	debugf("Site builder writing %q", goMod)
+	return ioutil.WriteFile(goMod, []byte(content), 0644)
 }
 
-func (me *siteBuilder) formatOneSource(sourceFile string) error {
-	origGopath := os.Getenv("GOPATH")
-	err := os.Setenv("GOPATH", me.OutputGopath)
-	if err != nil {
-		return err
+// checkAspenImportPath makes sure that generated sources will be able to
+// import aspen-go at the configured path, by resolving it with the go tool in
+// the environment that compiles them.  In module mode, this needs go.mod.
+func (me *siteBuilder) checkAspenImportPath() error {
+	args := []string{"list", "-f", "{{.Name}}"}
+	if me.ModuleMode {
+		args = append(args, "-mod=mod")
 	}
 
-	defer os.Setenv("GOPATH", origGopath)
+	cmd := me.goCommand(append(args, me.AspenImportPath)...)
+	cmd.Stdout = nil
+	cmd.Stderr = nil
+	out, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+			err = errors.New(strings.TrimSpace(string(exitErr.Stderr)))
+		}
 
-	formatCmd := exec.Command(me.goexe, "fmt", me.GenPackage)
-	formatCmd.Stdout = os.Stdout
-	formatCmd.Stderr = os.Stderr
+		return fmt.Errorf("Can't resolve aspen-go import path %q! %v", me.AspenImportPath, err)
+	}
 
-	err = formatCmd.Run()
-	if err != nil {
-		return err
+	name := strings.TrimSpace(string(out))
+	if name != "aspen" {
+		return fmt.Errorf("Package at aspen-go import path %q is %q, not aspen!",
+			me.AspenImportPath, name)
 	}
 
 	return nil
 }
 
-func (me *siteBuilder) formatSources(sources []string) error {
-	debugf("Site builder formatting sources")
-	for _, source := range sources {
-		err := me.formatOneSource(source)
-		if err != nil {
-			return err
-		}
+// tidyModule resolves the generated module's requirements, so that the
+// generated package can be type-checked.
+func (me *siteBuilder) tidyModule() error {
+	debugf("Site builder tidying generated module")
+	return me.goCommand("mod", "tidy").Run()
+}
+
+// GenPackageImport is the import path of the generated package.
+func (me *siteBuilder) GenPackageImport() string {
+	if me.ModuleMode {
+		return me.ModulePath + "/" + me.GenPackage
 	}
 
-	return nil
+	return me.GenPackage
 }
 
+// DefaultServerBinary is where the server binary for the generated package is
+// written unless configured otherwise.
+func DefaultServerBinary(outputPath, genPackage string) string {
+	return path.Join(outputPath, "bin", genPackage+"-http-server")
+}
+
+// sourcesList returns the generated package's sources, less any that library
+// sources exclude from the current build with build constraints.
 func (me *siteBuilder) sourcesList() ([]string, error) {
-	return filepath.Glob(path.Join(me.packagePath, "*.go"))
+	all, err := filepath.Glob(path.Join(me.packagePath, "*.go"))
+	if err != nil {
+		return nil, err
+	}
+
+	sources := []string{}
+	for _, source := range all {
+		match, err := build.Default.MatchFile(me.packagePath, filepath.Base(source))
+		if err != nil {
+			return nil, err
+		}
+
+		if match {
+			sources = append(sources, source)
+		}
+	}
+
+	return sources, nil
 }
 
 func (me *siteBuilder) ensureSourcesWritten() ([]string, error) {
@@ -391,13 +852,25 @@ func (me *siteBuilder) Build() error {
 		return err
 	}
 
+	err = me.checkAspenImportPath()
+	if err != nil {
+		return err
+	}
+
 	sources, err := me.ensureSourcesWritten()
 	if err != nil {
 		return err
 	}
 
-	if me.Format {
-		err = me.formatSources(sources)
+	if me.TypeCheck {
+		if me.ModuleMode {
+			err = me.tidyModule()
+			if err != nil {
+				return err
+			}
+		}
+
+		err = me.typeCheckSources(sources)
 		if err != nil {
 			return err
 		}
@@ -419,17 +892,32 @@ func (me *siteBuilder) IndicesString() string {
 
 /*
 Build non-static simplates found in the given document root
-(SiteBuilderCfg.WwwRoot) into Go sources written to the src dir of a given
+(SiteBuilderCfg.WwwRoot), which may be an archive of one, or found in
+SiteBuilderCfg.WwwFS, into Go sources written to the src dir of a given
 GOPATH entry (SiteBuilderCfg.OutputGopath).  The generated package
 (SiteBuilderCfg.GenPackage) will be used as the output source directory name
 and written as the package declaration for each generated Go source file.  An
 http server source will also be written to a directory nested within the
-generated package.
-
-Sources may be formatted via `gofmt` by setting the passed-in
-SiteBuilderCfg.Format to true.  The generated package and http executable may
-be automatically compiled by setting the passed-in SiteBuilderCfg.Compile to
-true.
+generated package.  Files whose extension isn't among SimplateExtensions,
+binary files, and files matching SiteBuilderCfg.StaticPaths are always static.
+Simplates are parsed and generated by SiteBuilderCfg.Jobs goroutines at once,
+without affecting the output.
+
+Sources may be formatted in-process, as by `gofmt`, by setting the passed-in
+SiteBuilderCfg.Format to true.  The generated package may be type-checked
+in-process, reporting every error against its simplate, by setting the
+passed-in SiteBuilderCfg.TypeCheck to true.  The generated package and http
+executable may be automatically compiled by setting the passed-in
+SiteBuilderCfg.Compile to true.
+
+With SiteBuilderCfg.ModuleMode set, SiteBuilderCfg.OutputGopath is instead the
+root of a generated Go module (SiteBuilderCfg.ModulePath), whose go.mod may
+replace aspen-go with a local checkout (SiteBuilderCfg.AspenReplace).  The
+server binary is written to SiteBuilderCfg.ServerBinary in either mode.
+
+With SiteBuilderCfg.EmbedStatic set, static files are copied into the
+generated package and embedded in the server, which then needs no www root.
+Passing --www_root to the server still serves static files from disk.
 
 The generated server will support the following options, defaulted to the values
 passed to BuildMain:
@@ -451,9 +939,25 @@ func BuildMain(cfg *SiteBuilderCfg) int {
 
 	err = builder.Build()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		printBuildError(err)
 		return 2
 	}
 
+	fmt.Printf("Simplates: %v\n", builder.summary)
 	return 0
 }
+
+// printBuildError prints simplate errors in "file:line:col: message" form, one
+// per line, so that editors can jump to them.
+func printBuildError(err error) {
+	switch e := err.(type) {
+	case MultiError:
+		for _, err := range e {
+			printBuildError(err)
+		}
+	case *SimplateError:
+		fmt.Fprintln(os.Stderr, e)
+	default:
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+	}
+}
@@ -2,7 +2,36 @@
 Go port of the Aspen web framework (http://aspen.io).
 
 aspen currently supports rendered, negotiated, and static Simplates as
-described here: http://aspen.io/simplates/. The only template engine
-implemented is Go's standard library "text/template".
+described here: http://aspen.io/simplates/. The template engines implemented
+are Go's standard library "text/template" and "html/template".  Template pages
+of type text/html and application/xhtml+xml are rendered with "html/template"
+by default; use a "#!go/text/template" specline to opt out.  Template pages
+with a "#!markdown" specline are run through "text/template" and the resulting
+CommonMark is converted to HTML.  Additional template engines may be
+registered with RegisterRenderer and selected by name in a template page's
+specline.  Speclines follow Aspen's "media/type via renderer" grammar, where
+either part may be omitted and the media type may carry parameters such as
+"; charset=utf-8".
+
+Paths matching the .gitignore-style patterns in a .aspenignore file at the
+www root are neither built nor served.  Dotfiles, editor backup and swap
+files, and node_modules directories are ignored by default; a pattern such as
+"!.well-known/" re-includes them.
+
+Static files may be embedded in the generated server with aspen-build's
+--embed_static (-E) flag, so that it can be deployed without its www root.
+Passing --www_root to such a server serves static files from disk instead.
+
+The www root may also be a zip or tar archive (optionally gzipped) of a
+directory, both when building and when serving.  Website.SetStaticFS and
+SiteBuilderCfg.WwwFS accept any io/fs file system in place of the www root.
+
+Every simplate is generated into the same Go package, so the top-level
+declarations of each init page are renamed to be unique to its simplate.
+Simplates written independently may therefore declare the same names.
+
+Go sources in the www root's _lib directory (or another configured with
+SiteBuilderCfg.LibDir) are built into the generated package, so that every
+simplate may use them.  The library directory is never served.
 */
 package aspen
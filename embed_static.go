@@ -0,0 +1,241 @@
+package aspen
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"unicode"
+)
+
+const (
+	staticEmbedDir    = "aspen_static"
+	staticEmbedSource = "aspen-static-embed.go"
+)
+
+var (
+	staticEmbedTemplate = template.Must(template.New("aspen-static-embed").Parse(`
+package {{.GenPackage}}
+// GENERATED FILE - DO NOT EDIT
+// Rebuild with aspen-build!
+
+import (
+    "embed"
+    "io/fs"
+
+    aspen "{{.AspenImportPath}}"
+)
+
+{{if .HasStatic}}//go:embed {{.Dir}}
+{{end}}var aspenStaticFiles embed.FS
+
+func init() {
+    staticFS, err := fs.Sub(aspenStaticFiles, "{{.Dir}}")
+    if err != nil {
+        panic(err)
+    }
+
+    aspen.DeclareWebsite("{{.GenPackage}}").SetStaticFS(staticFS)
+}
+`))
+)
+
+/*
+writeStaticEmbed copies the site's static files into the generated package and
+writes a source file embedding them, so that the generated server can be
+deployed without its www root.  Only files that changed since the previous
+build are copied, and files no longer in the site are removed.  Without
+EmbedStatic, anything left by a previous embedding build is removed.
+*/
+func (me *siteBuilder) writeStaticEmbed(simplates []*simplate) error {
+	embedSource := path.Join(me.packagePath, staticEmbedSource)
+	embedDir := path.Join(me.packagePath, staticEmbedDir)
+
+	if !me.EmbedStatic {
+		err := os.Remove(embedSource)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		return os.RemoveAll(embedDir)
+	}
+
+	debugf("Site builder embedding static files in %q", embedDir)
+	wanted := map[string]bool{}
+
+	for _, simplate := range simplates {
+		if simplate.Type != SimplateTypeStatic {
+			continue
+		}
+
+		name := filepath.ToSlash(simplate.Filename)
+		if !embeddableName(name) {
+			fmt.Fprintf(os.Stderr, "WARNING: %q can't be embedded, "+
+				"so will only be served from the www root on disk\n", simplate.Filename)
+			continue
+		}
+
+		dest := filepath.Join(embedDir, simplate.Filename)
+		wanted[dest] = true
+
+		err := copyIfChanged(me.walker.FS, name, dest)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := pruneDir(embedDir, wanted)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	err = staticEmbedTemplate.Execute(&buf, map[string]interface{}{
+		"GenPackage":      me.GenPackage,
+		"AspenImportPath": me.AspenImportPath,
+		"Dir":             staticEmbedDir,
+		"HasStatic":       len(wanted) > 0,
+	})
+	if err != nil {
+		return err
+	}
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	return writeFileIfChanged(embedSource, src)
+}
+
+// embeddableName reports whether go:embed accepts the slash-separated name.
+// Names with elements beginning with "." or "_" are skipped by a directory
+// pattern, and some punctuation is never allowed.
+func embeddableName(name string) bool {
+	for _, elem := range strings.Split(name, "/") {
+		if len(elem) == 0 || strings.HasPrefix(elem, ".") ||
+			strings.HasPrefix(elem, "_") || strings.HasSuffix(elem, ".") {
+			return false
+		}
+
+		for _, r := range elem {
+			if r < unicode.MaxASCII {
+				if !unicode.IsLetter(r) && !unicode.IsDigit(r) &&
+					!strings.ContainsRune("!#$%&()+,-.=@[]^_{}~ ", r) {
+					return false
+				}
+			} else if !unicode.IsLetter(r) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// copyIfChanged copies the file at name within fsys to dest unless dest has
+// the same size and modification time, which it is given when copied.
+func copyIfChanged(fsys fs.FS, name, dest string) error {
+	srcFi, err := fs.Stat(fsys, name)
+	if err != nil {
+		return err
+	}
+
+	destFi, err := os.Stat(dest)
+	if err == nil && destFi.Size() == srcFi.Size() &&
+		destFi.ModTime().Equal(srcFi.ModTime()) {
+		return nil
+	}
+
+	debugf("Copying %q to %q", name, dest)
+	err = os.MkdirAll(filepath.Dir(dest), os.ModeDir|(os.FileMode)(0755))
+	if err != nil {
+		return err
+	}
+
+	in, err := fsys.Open(name)
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	err = out.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Chtimes(dest, srcFi.ModTime(), srcFi.ModTime())
+}
+
+// pruneDir removes files beneath dir that aren't wanted, along with any
+// directories left empty.
+func pruneDir(dir string, wanted map[string]bool) error {
+	dirs := []string{}
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			dirs = append(dirs, path)
+			return nil
+		}
+
+		if wanted[path] {
+			return nil
+		}
+
+		debugf("Removing stale embedded file %q", path)
+		return os.Remove(path)
+	})
+	if err != nil {
+		return err
+	}
+
+	// deepest first, so that emptied parents can be removed too
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, d := range dirs {
+		entries, err := os.ReadDir(d)
+		if err == nil && len(entries) == 0 {
+			err = os.Remove(d)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func writeFileIfChanged(filename string, content []byte) error {
+	existing, err := os.ReadFile(filename)
+	if err == nil && bytes.Equal(existing, content) {
+		return nil
+	}
+
+	return os.WriteFile(filename, content, 0644)
+}
@@ -0,0 +1,72 @@
+package aspen
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	SimplateErrorUnexpectedExtension = "unexpected-extension"
+	SimplateErrorMixedPageBreaks     = "mixed-page-breaks"
+	SimplateErrorInvalidSpecline     = "invalid-specline"
+	SimplateErrorUnknownRenderer     = "unknown-renderer"
+	SimplateErrorInvalidTemplate     = "invalid-template"
+	SimplateErrorGoSyntax            = "go-syntax"
+	SimplateErrorGoType              = "go-type"
+	SimplateErrorCodegen             = "codegen"
+	SimplateErrorNameCollision       = "name-collision"
+)
+
+/*
+SimplateError describes a problem found in a simplate source file.  Its Error
+method formats it as "file:line:col: message" so that editors can jump to the
+offending location.
+*/
+type SimplateError struct {
+	Filename string
+	// zero-based index of the offending page, or -1 if not page-specific
+	Page int
+	// one-based line and column; zero when unknown
+	Line   int
+	Column int
+	// machine-readable error code, one of the SimplateError* constants
+	Code    string
+	Message string
+}
+
+// MultiError collects several errors, e.g. every broken simplate in a tree.
+type MultiError []error
+
+func newSimplateError(filename string, page, line, column int,
+	code, format string, v ...interface{}) *SimplateError {
+
+	return &SimplateError{
+		Filename: filename,
+		Page:     page,
+		Line:     line,
+		Column:   column,
+		Code:     code,
+		Message:  fmt.Sprintf(format, v...),
+	}
+}
+
+func (me *SimplateError) Error() string {
+	pos := me.Filename
+	if me.Line > 0 {
+		pos = fmt.Sprintf("%s:%d", pos, me.Line)
+		if me.Column > 0 {
+			pos = fmt.Sprintf("%s:%d", pos, me.Column)
+		}
+	}
+
+	return fmt.Sprintf("%s: %s", pos, me.Message)
+}
+
+func (me MultiError) Error() string {
+	msgs := []string{}
+	for _, err := range me {
+		msgs = append(msgs, err.Error())
+	}
+
+	return strings.Join(msgs, "\n")
+}
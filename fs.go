@@ -0,0 +1,246 @@
+package aspen
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	// ArchiveExtensions lists the file extensions of archives that may be
+	// used in place of a www root directory.
+	ArchiveExtensions = []string{".zip", ".tar", ".tar.gz", ".tgz"}
+)
+
+/*
+OpenWwwFS opens a www root for building or serving, which may be a directory
+or a zip or tar archive (optionally gzipped) whose top level is the www root.
+Zip archives are read as needed and stay open for the life of the process,
+while tar archives are read into memory at once.
+*/
+func OpenWwwFS(wwwRoot string) (fs.FS, error) {
+	fi, err := os.Stat(wwwRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	if fi.IsDir() {
+		return os.DirFS(wwwRoot), nil
+	}
+
+	switch archiveExtension(wwwRoot) {
+	case ".zip":
+		debugf("Opening zip archive %q as www root", wwwRoot)
+		return zip.OpenReader(wwwRoot)
+	case ".tar", ".tar.gz", ".tgz":
+		debugf("Reading tar archive %q as www root", wwwRoot)
+		return openTarFS(wwwRoot)
+	}
+
+	return nil, fmt.Errorf("%q is neither a directory nor a zip or tar archive!", wwwRoot)
+}
+
+func archiveExtension(filename string) string {
+	lower := strings.ToLower(filename)
+	for _, ext := range ArchiveExtensions {
+		if strings.HasSuffix(lower, ext) {
+			return ext
+		}
+	}
+
+	return ""
+}
+
+func isArchive(filename string) bool {
+	return len(archiveExtension(filename)) > 0
+}
+
+func openTarFS(filename string) (fs.FS, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	var r io.Reader = f
+	if archiveExtension(filename) != ".tar" {
+		gzr, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+
+		defer gzr.Close()
+		r = gzr
+	}
+
+	fsys, err := readTarFS(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+
+	return fsys, nil
+}
+
+// tarFS is a read-only in-memory file system of the directories and regular
+// files of a tar archive.  Directories missing from the archive are implied
+// by the entries within them.
+type tarFS map[string]*tarEntry
+
+type tarEntry struct {
+	name    string
+	data    []byte
+	mode    fs.FileMode
+	modTime time.Time
+	// sorted entries of a directory
+	entries []fs.DirEntry
+}
+
+// readTarFS reads the directories and regular files of a tar stream into an
+// in-memory file system.  Links and special files are skipped.
+func readTarFS(r io.Reader) (tarFS, error) {
+	fsys := tarFS{".": {name: ".", mode: fs.ModeDir | 0555}}
+	tr := tar.NewReader(r)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		name := path.Clean(strings.TrimLeft(hdr.Name, "/"))
+		if name == "." {
+			continue
+		}
+
+		if !fs.ValidPath(name) {
+			return nil, fmt.Errorf("Invalid path %q in tar archive!", hdr.Name)
+		}
+
+		mode := hdr.FileInfo().Mode()
+		entry := &tarEntry{name: path.Base(name), mode: mode, modTime: hdr.ModTime}
+
+		switch {
+		case mode.IsDir():
+		case mode.IsRegular():
+			entry.data, err = io.ReadAll(tr)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			debugf("Skipping tar entry %q of mode %v", hdr.Name, mode)
+			continue
+		}
+
+		fsys[name] = entry
+	}
+
+	names := []string{}
+	for name := range fsys {
+		names = append(names, name)
+	}
+
+	for _, name := range names {
+		for child := name; child != "."; {
+			dir := path.Dir(child)
+			parent, ok := fsys[dir]
+			if !ok {
+				parent = &tarEntry{name: path.Base(dir), mode: fs.ModeDir | 0555}
+				fsys[dir] = parent
+			}
+
+			if !parent.IsDir() {
+				return nil, fmt.Errorf("Tar archive entry %q is within file %q!", name, dir)
+			}
+
+			parent.entries = append(parent.entries, fs.FileInfoToDirEntry(fsys[child]))
+			if ok {
+				break
+			}
+
+			child = dir
+		}
+	}
+
+	for _, entry := range fsys {
+		sort.Slice(entry.entries, func(i, j int) bool {
+			return entry.entries[i].Name() < entry.entries[j].Name()
+		})
+	}
+
+	return fsys, nil
+}
+
+func (me tarFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	entry, ok := me[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+
+	if entry.IsDir() {
+		return &tarDir{tarEntry: entry}, nil
+	}
+
+	return &tarFile{tarEntry: entry, Reader: bytes.NewReader(entry.data)}, nil
+}
+
+func (me *tarEntry) Name() string       { return me.name }
+func (me *tarEntry) Size() int64        { return int64(len(me.data)) }
+func (me *tarEntry) Mode() fs.FileMode  { return me.mode }
+func (me *tarEntry) ModTime() time.Time { return me.modTime }
+func (me *tarEntry) IsDir() bool        { return me.mode.IsDir() }
+func (me *tarEntry) Sys() interface{}   { return nil }
+
+type tarFile struct {
+	*tarEntry
+	*bytes.Reader
+}
+
+func (me *tarFile) Stat() (fs.FileInfo, error) { return me.tarEntry, nil }
+func (me *tarFile) Close() error               { return nil }
+
+// Size resolves the ambiguity between the embedded entry and reader.
+func (me *tarFile) Size() int64 { return me.tarEntry.Size() }
+
+type tarDir struct {
+	*tarEntry
+	offset int
+}
+
+func (me *tarDir) Stat() (fs.FileInfo, error) { return me.tarEntry, nil }
+func (me *tarDir) Close() error               { return nil }
+
+func (me *tarDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: me.name, Err: fs.ErrInvalid}
+}
+
+func (me *tarDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	rest := me.entries[me.offset:]
+	if n > 0 && len(rest) == 0 {
+		return nil, io.EOF
+	}
+
+	if n > 0 && n < len(rest) {
+		rest = rest[:n]
+	}
+
+	me.offset += len(rest)
+	return append([]fs.DirEntry{}, rest...), nil
+}
@@ -8,13 +8,11 @@ import (
 
 const (
 	internalAcceptHeader = "X-AspenGo-Accept"
-	pathTransHeader      = "X-HTTP-Path-Translated"
 )
 
 var (
 	vPathPart    = regexp.MustCompile("%([a-zA-Z_][-a-zA-Z0-9_]*)")
 	vPathPartRep = "(?P<$1>[a-zA-Z_][-a-zA-Z0-9_]*)"
-	nonAlNumDash = regexp.MustCompile("[^-a-zA-Z0-9]")
 )
 
 type handlerFuncRegistration struct {
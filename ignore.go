@@ -0,0 +1,192 @@
+package aspen
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	IgnoreFilename = ".aspenignore"
+)
+
+var (
+	// DefaultIgnorePatterns are always in effect, ahead of the patterns in a
+	// www root's .aspenignore, which may re-include paths with "!pattern".
+	DefaultIgnorePatterns = []string{".*", "*~", `\#*#`, "*.swp", "node_modules/"}
+)
+
+/*
+ignoreMatcher decides which paths under a www root are neither built nor
+served.  Patterns follow .gitignore: "#" begins a comment, "!" negates a
+pattern, a trailing "/" matches only directories, a pattern containing any
+other "/" is anchored to the www root, and "**" matches any number of
+directories.  The last matching pattern wins, and nothing beneath an ignored
+directory can be re-included.  Only the .aspenignore at the www root is read.
+*/
+type ignoreMatcher struct {
+	rules []*ignoreRule
+}
+
+type ignoreRule struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// loadIgnoreMatcher reads the .aspenignore at the top of fsys, the www root
+// found at wwwRoot, which is only used in error messages.
+func loadIgnoreMatcher(fsys fs.FS, wwwRoot string) (*ignoreMatcher, error) {
+	ignoreFile := filepath.Join(wwwRoot, IgnoreFilename)
+	content, err := fs.ReadFile(fsys, IgnoreFilename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return newIgnoreMatcher(ignoreFile, nil)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return newIgnoreMatcher(ignoreFile, content)
+}
+
+// newIgnoreMatcher builds a matcher from the default patterns followed by the
+// .gitignore-style content read from filename.
+func newIgnoreMatcher(filename string, content []byte) (*ignoreMatcher, error) {
+	im := &ignoreMatcher{}
+
+	for _, pattern := range DefaultIgnorePatterns {
+		err := im.addPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for lineno := 1; scanner.Scan(); lineno++ {
+		err := im.addPattern(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, lineno, err)
+		}
+	}
+
+	return im, scanner.Err()
+}
+
+func (me *ignoreMatcher) addPattern(line string) error {
+	pattern := strings.TrimRight(line, " \t\r")
+	if len(pattern) == 0 || strings.HasPrefix(pattern, "#") {
+		return nil
+	}
+
+	rule := &ignoreRule{}
+	if strings.HasPrefix(pattern, "!") {
+		rule.negate = true
+		pattern = pattern[1:]
+	} else if strings.HasPrefix(pattern, `\`) {
+		pattern = pattern[1:]
+	}
+
+	if strings.HasSuffix(pattern, "/") {
+		rule.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+
+	if len(pattern) == 0 {
+		return fmt.Errorf("Invalid ignore pattern %q!", line)
+	}
+
+	prefix := "^(?:.*/)?"
+	if strings.Contains(pattern, "/") {
+		prefix = "^"
+		pattern = strings.TrimPrefix(pattern, "/")
+	}
+
+	re, err := regexp.Compile(prefix + globToRegexp(pattern) + "$")
+	if err != nil {
+		return fmt.Errorf("Invalid ignore pattern %q! %v", line, err)
+	}
+
+	rule.re = re
+	me.rules = append(me.rules, rule)
+	return nil
+}
+
+// Ignored reports whether relPath, a slash-separated path relative to the www
+// root, is ignored, either itself or by way of a parent directory.
+func (me *ignoreMatcher) Ignored(relPath string, isDir bool) bool {
+	relPath = strings.Trim(filepath.ToSlash(relPath), "/")
+	if len(relPath) == 0 || relPath == "." {
+		return false
+	}
+
+	parts := strings.Split(relPath, "/")
+	for i := 1; i < len(parts); i++ {
+		if me.match(strings.Join(parts[:i], "/"), true) {
+			return true
+		}
+	}
+
+	return me.match(relPath, isDir)
+}
+
+func (me *ignoreMatcher) match(relPath string, isDir bool) bool {
+	ignored := false
+	for _, rule := range me.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+
+		if rule.re.MatchString(relPath) {
+			ignored = !rule.negate
+		}
+	}
+
+	return ignored
+}
+
+func globToRegexp(glob string) string {
+	var buf bytes.Buffer
+
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			buf.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			buf.WriteString(".*")
+			i++
+		case c == '*':
+			buf.WriteString("[^/]*")
+		case c == '?':
+			buf.WriteString("[^/]")
+		case c == '\\' && i+1 < len(glob):
+			i++
+			buf.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		case c == '[':
+			end := strings.Index(glob[i+1:], "]")
+			if end < 0 {
+				buf.WriteString(`\[`)
+				continue
+			}
+
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+
+			buf.WriteString("[" + class + "]")
+			i += end + 1
+		default:
+			buf.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+
+	return buf.String()
+}
@@ -0,0 +1,208 @@
+package aspen
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	majorVersionElem = regexp.MustCompile(`^v[0-9]+$`)
+)
+
+// importSpec is a single import of a generated source, with an empty Name
+// unless the package is imported under another name.
+type importSpec struct {
+	Name string
+	Path string
+}
+
+func newImportSpec(spec *ast.ImportSpec) *importSpec {
+	ispec := &importSpec{}
+	ispec.Path, _ = strconv.Unquote(spec.Path.Value)
+	if spec.Name != nil {
+		ispec.Name = spec.Name.Name
+	}
+
+	return ispec
+}
+
+// parseImportSpec parses an import spec as returned by Renderer.Imports, e.g.
+// `"text/template"` or `htmltemplate "html/template"`.
+func parseImportSpec(spec string) (*importSpec, error) {
+	fields := strings.Fields(spec)
+	ispec := &importSpec{}
+
+	switch len(fields) {
+	case 2:
+		ispec.Name = fields[0]
+		fields = fields[1:]
+		fallthrough
+	case 1:
+		importPath, err := strconv.Unquote(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid import spec %q!", spec)
+		}
+
+		ispec.Path = importPath
+		return ispec, nil
+	}
+
+	return nil, fmt.Errorf("Invalid import spec %q!", spec)
+}
+
+func (me *importSpec) String() string {
+	if len(me.Name) > 0 {
+		return me.Name + " " + strconv.Quote(me.Path)
+	}
+
+	return strconv.Quote(me.Path)
+}
+
+// LocalName is the name by which the importing file refers to the package.
+func (me *importSpec) LocalName() string {
+	if len(me.Name) > 0 {
+		return me.Name
+	}
+
+	return guessPackageName(me.Path)
+}
+
+/*
+guessPackageName guesses the name of the package at importPath without
+finding it, following the usual conventions: a trailing major version
+element or ".vN" suffix is dropped, as is a "go-" prefix or "-go" suffix, and
+the name ends at the first remaining "." or "-".
+*/
+func guessPackageName(importPath string) string {
+	elems := strings.Split(importPath, "/")
+	name := elems[len(elems)-1]
+	if len(elems) > 1 && majorVersionElem.MatchString(name) {
+		name = elems[len(elems)-2]
+	}
+
+	name = strings.TrimSuffix(strings.TrimPrefix(name, "go-"), "-go")
+	if i := strings.IndexAny(name, ".-"); i > 0 {
+		name = name[:i]
+	}
+
+	return name
+}
+
+// genImports returns the imports that the generated source of the simplate
+// needs, before those of its init page are merged in.
+func (me *simplate) genImports() []*importSpec {
+	aspenImportPath := me.AspenImportPath
+	if len(aspenImportPath) == 0 {
+		aspenImportPath = DefaultAspenImportPath
+	}
+
+	imports := []*importSpec{
+		{Path: "net/http"},
+		{Name: "aspen", Path: aspenImportPath},
+	}
+
+	if me.Type == SimplateTypeJson {
+		return imports
+	}
+
+	imports = append(imports, &importSpec{Path: "bytes"})
+	for _, spec := range me.TemplateImports() {
+		ispec, err := parseImportSpec(spec)
+		if err != nil {
+			panic(err)
+		}
+
+		imports = append(imports, ispec)
+	}
+
+	imports, _ = mergeImports(nil, imports)
+	return imports
+}
+
+/*
+mergeImports adds the imports of an init page to those of the generated
+source.  Imports of a package already imported under the same name are
+dropped.  An import whose name clashes with that of another package is given
+an alias, returned by its original spec, to which uses of it must be renamed.
+Blank and dot imports are only ever de-duplicated.
+*/
+func mergeImports(imports, initImports []*importSpec) ([]*importSpec, map[*importSpec]string) {
+	merged := append([]*importSpec{}, imports...)
+	aliased := map[*importSpec]string{}
+
+	taken := map[string]bool{}
+	for _, ispec := range merged {
+		taken[ispec.LocalName()] = true
+	}
+
+	for _, ispec := range initImports {
+		name := ispec.LocalName()
+		duplicate := false
+		clash := false
+
+		for _, other := range merged {
+			if other.LocalName() != name {
+				continue
+			}
+
+			if other.Path == ispec.Path {
+				duplicate = true
+				break
+			}
+
+			clash = name != "_" && name != "."
+		}
+
+		if duplicate {
+			continue
+		}
+
+		if clash {
+			alias := name
+			for i := 1; taken[alias]; i++ {
+				alias = fmt.Sprintf("%s_%d", name, i)
+			}
+
+			aliased[ispec] = alias
+			ispec = &importSpec{Name: alias, Path: ispec.Path}
+		}
+
+		taken[ispec.LocalName()] = true
+		merged = append(merged, ispec)
+	}
+
+	return merged, aliased
+}
+
+// ImportDecl is the single import declaration of the generated source.
+func (me *simplate) ImportDecl() string {
+	me.isolateDeclarations()
+	if me.imports == nil {
+		me.imports = me.genImports()
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("import (\n")
+	for _, ispec := range me.imports {
+		fmt.Fprintf(&buf, "    %s\n", ispec)
+	}
+
+	buf.WriteString(")\n")
+	return buf.String()
+}
+
+// blankOut replaces everything but newlines with spaces, so that source may
+// be removed without moving the lines after it.
+func blankOut(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\n' {
+			return r
+		}
+
+		return ' '
+	}, s)
+}
@@ -0,0 +1,175 @@
+package aspen
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"sort"
+	"strings"
+)
+
+const (
+	// the generated handler's locals, which the logic page may use and which
+	// shadow any like-named declarations in the init page
+	isolateLogicHeader = "\nfunc _(w, request, response, website, err, __file__ interface{}, " +
+		"ctx map[string]interface{}) {\n"
+)
+
+// isolatedName is the name under which a top-level declaration in the
+// simplate's init page is generated, so that simplates sharing the generated
+// package may declare the same names.
+func (me *simplate) isolatedName(name string) string {
+	return name + me.isolationSuffix()
+}
+
+func (me *simplate) isolationSuffix() string {
+	return "__" + me.FuncName()
+}
+
+// unisolate restores the names of the simplate's top-level declarations in
+// msg, e.g. a type error reported against the generated source.
+func (me *simplate) unisolate(msg string) string {
+	return strings.Replace(msg, me.isolationSuffix(), "", -1)
+}
+
+/*
+isolateDeclarations renames the top-level declarations of the init page, and
+every use of them in the init and logic pages, to their isolated names.  Uses
+are found by type-checking the two pages on their own, with imports faked and
+errors ignored, so that fields, methods and locals that happen to share a
+name are left alone.  The init page's imports are blanked out and merged with
+those of the generated source by mergeImports.  Names are spliced in place,
+keeping every line where it was.  Pages that don't parse are left as they
+are, to be reported against the simplate when the generated source is
+formatted or type-checked.
+*/
+func (me *simplate) isolateDeclarations() {
+	if me.InitPage == nil || me.LogicPage == nil || me.isolated {
+		return
+	}
+
+	me.isolated = true
+	me.imports = me.genImports()
+	initBody, logicBody := me.InitPage.Body, me.LogicPage.Body
+	me.InitPage.genBody, me.LogicPage.genBody = initBody, logicBody
+
+	initStart := len("package p\n")
+	logicStart := initStart + len(me.InitPage.Body) + len(isolateLogicHeader)
+	src := "package p\n" + me.InitPage.Body + isolateLogicHeader + me.LogicPage.Body + "\n}\n"
+
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, me.AbsFilename, src, parser.SkipObjectResolution)
+	if err != nil {
+		debugf("Not isolating declarations of unparseable simplate %q: %v", me.Filename, err)
+		return
+	}
+
+	info := &types.Info{
+		Defs:      map[*ast.Ident]types.Object{},
+		Uses:      map[*ast.Ident]types.Object{},
+		Implicits: map[ast.Node]types.Object{},
+	}
+
+	cfg := &types.Config{
+		Importer: fakeImporter{},
+		Error:    func(error) {},
+	}
+
+	pkg, _ := cfg.Check("p", fset, []*ast.File{f}, info)
+
+	// the init page's imports, which are generated along with the rest
+	initImports := []*importSpec{}
+	importObjs := map[*importSpec]types.Object{}
+	for _, decl := range f.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.IMPORT {
+			continue
+		}
+
+		for _, spec := range gen.Specs {
+			ispec := newImportSpec(spec.(*ast.ImportSpec))
+			initImports = append(initImports, ispec)
+			importObjs[ispec] = info.Implicits[spec]
+			if ispec.Name != "" {
+				importObjs[ispec] = info.Defs[spec.(*ast.ImportSpec).Name]
+			}
+		}
+
+		start := fset.Position(gen.Pos()).Offset - initStart
+		end := fset.Position(gen.End()).Offset - initStart
+		initBody = initBody[:start] + blankOut(initBody[start:end]) + initBody[end:]
+	}
+
+	var aliased map[*importSpec]string
+	me.imports, aliased = mergeImports(me.imports, initImports)
+
+	renames := map[types.Object]string{}
+	for ispec, alias := range aliased {
+		if obj := importObjs[ispec]; obj != nil {
+			renames[obj] = alias
+		}
+	}
+
+	// offsets of every identifier to rename, and the identifiers themselves
+	offsets := []int{}
+	idents := map[int]*ast.Ident{}
+	collect := func(all map[*ast.Ident]types.Object) {
+		for ident, obj := range all {
+			if obj == nil {
+				continue
+			}
+
+			_, aliasedImport := renames[obj]
+			declared := obj.Parent() == pkg.Scope() && obj.Name() != "_" &&
+				obj.Name() != "init"
+			if !aliasedImport && !declared {
+				continue
+			}
+
+			offset := fset.Position(ident.Pos()).Offset
+			offsets = append(offsets, offset)
+			idents[offset] = ident
+		}
+	}
+
+	collect(info.Defs)
+	collect(info.Uses)
+
+	// splice from the end, so that earlier offsets stay valid
+	sort.Sort(sort.Reverse(sort.IntSlice(offsets)))
+	for _, offset := range offsets {
+		ident := idents[offset]
+		name := me.isolatedName(ident.Name)
+		if alias, ok := renames[info.Uses[ident]]; ok {
+			name = alias
+		}
+
+		switch {
+		case offset >= logicStart:
+			logicBody = splice(logicBody, offset-logicStart, ident.Name, name)
+		case offset >= initStart:
+			initBody = splice(initBody, offset-initStart, ident.Name, name)
+		}
+	}
+
+	me.InitPage.genBody, me.LogicPage.genBody = initBody, logicBody
+}
+
+func splice(s string, offset int, old, new string) string {
+	if offset+len(old) > len(s) || s[offset:offset+len(old)] != old {
+		return s
+	}
+
+	return s[:offset] + new + s[offset+len(old):]
+}
+
+// fakeImporter stands in for every import with an empty package, as only the
+// simplate's own declarations matter when isolating them.
+type fakeImporter struct{}
+
+func (fakeImporter) Import(importPath string) (*types.Package, error) {
+	pkg := types.NewPackage(importPath, guessPackageName(importPath))
+	pkg.MarkComplete()
+	return pkg, nil
+}
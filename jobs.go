@@ -0,0 +1,52 @@
+package aspen
+
+import (
+	"runtime"
+	"sync"
+)
+
+// DefaultJobs is the number of simplates parsed or generated at once when no
+// other number is configured.
+var DefaultJobs = runtime.NumCPU()
+
+// runJobs calls fn for each of 0..n-1 using at most jobs goroutines.  Errors
+// are returned in index order, regardless of the order in which jobs finish.
+func runJobs(jobs, n int, fn func(i int) error) MultiError {
+	if jobs < 1 {
+		jobs = DefaultJobs
+	}
+
+	if jobs > n {
+		jobs = n
+	}
+
+	results := make([]error, n)
+	indices := make(chan int)
+
+	var wg sync.WaitGroup
+	for w := 0; w < jobs; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				results[i] = fn(i)
+			}
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		indices <- i
+	}
+
+	close(indices)
+	wg.Wait()
+
+	errs := MultiError{}
+	for _, err := range results {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
@@ -0,0 +1,146 @@
+package aspen
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+const (
+	// DefaultLibDir is the directory of the www root, unless another is
+	// configured, whose Go sources are shared by every simplate.
+	DefaultLibDir = "_lib"
+
+	libSourcePrefix = "aspen-lib-"
+	libInitSource   = "aspen-lib.go"
+)
+
+var (
+	libInitTemplate = template.Must(template.New("aspen-lib").Parse(`
+package {{.GenPackage}}
+// GENERATED FILE - DO NOT EDIT
+// Rebuild with aspen-build!
+
+import (
+    aspen "{{.AspenImportPath}}"
+)
+
+func init() {
+    aspen.DeclareWebsite("{{.GenPackage}}").SetLibDir({{printf "%q" .LibDir}})
+}
+`))
+)
+
+/*
+writeLibSources copies the .go files at the top of the www root's library
+directory into the generated package, where every simplate may use them.
+Each copy has its package clause rewritten to that of the generated package,
+and begins with a line directive pointing back at the original, so that
+errors are reported against it.  Test files are skipped, and copies of files
+since removed from the library directory are deleted.  The generated package
+always declares the library directory, so that the server never serves it.
+*/
+func (me *siteBuilder) writeLibSources() error {
+	written := map[string]bool{}
+
+	entries, err := fs.ReadDir(me.walker.FS, me.LibDir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	errs := MultiError{}
+	for _, ent := range entries {
+		name := ent.Name()
+		if ent.IsDir() || path.Ext(name) != ".go" || strings.HasSuffix(name, "_test.go") ||
+			me.walker.ignore.Ignored(path.Join(me.LibDir, name), false) {
+			continue
+		}
+
+		outname := libSourcePrefix + name
+		err = me.writeLibSource(path.Join(me.LibDir, name), outname)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		written[outname] = true
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	stale, err := filepath.Glob(path.Join(me.packagePath, libSourcePrefix+"*.go"))
+	if err != nil {
+		return err
+	}
+
+	for _, source := range stale {
+		if !written[filepath.Base(source)] {
+			debugf("Site builder removing stale library source %q", source)
+			err = os.Remove(source)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// the library directory is never served, whether or not it holds any
+	// Go sources
+	libInit := path.Join(me.packagePath, libInitSource)
+	var buf bytes.Buffer
+	err = libInitTemplate.Execute(&buf, me)
+	if err != nil {
+		return err
+	}
+
+	return writeFileIfChanged(libInit, buf.Bytes())
+}
+
+func (me *siteBuilder) writeLibSource(name, outname string) error {
+	absFilename := filepath.Join(me.WwwRoot, filepath.FromSlash(name))
+
+	content, err := fs.ReadFile(me.walker.FS, name)
+	if err != nil {
+		return err
+	}
+
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, absFilename, content, parser.PackageClauseOnly)
+	if err != nil {
+		return err
+	}
+
+	// splice in the generated package's name, keeping every line in place
+	offset := fset.Position(f.Name.Pos()).Offset
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "//line %s:1\n", absFilename)
+	buf.Write(content[:offset])
+	buf.WriteString(me.GenPackage)
+	buf.Write(content[offset+len(f.Name.Name):])
+
+	outPath := path.Join(me.packagePath, outname)
+	debugf("Site builder copying library source %q to %q", absFilename, outPath)
+
+	err = os.MkdirAll(me.packagePath, os.ModeDir|(os.FileMode)(0755))
+	if err != nil {
+		return err
+	}
+
+	return writeFileIfChanged(outPath, buf.Bytes())
+}
+
+// isLibDir reports whether name, a slash-separated path relative to the www
+// root, is the library directory or within it.
+func isLibDir(libDir, name string) bool {
+	libDir = strings.Trim(path.Clean("/"+libDir), "/")
+	return len(libDir) > 0 && (name == libDir || strings.HasPrefix(name, libDir+"/"))
+}
@@ -0,0 +1,60 @@
+package aspen
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/yuin/goldmark"
+)
+
+const (
+	RendererMarkdown = "markdown"
+)
+
+/*
+MarkdownTemplate runs a template page through Go templating and converts the
+resulting CommonMark document to HTML.  Raw HTML in the document is omitted
+from the output, so values interpolated by the template can't inject markup.
+*/
+type MarkdownTemplate struct {
+	tmpl SimplateTemplate
+}
+
+type markdownRenderer struct{}
+
+func init() {
+	MustRegisterRenderer(RendererMarkdown, &markdownRenderer{})
+}
+
+func NewMarkdownTemplate(tmpl SimplateTemplate) *MarkdownTemplate {
+	return &MarkdownTemplate{tmpl: tmpl}
+}
+
+func (me *MarkdownTemplate) Execute(wr io.Writer, data interface{}) error {
+	var mdBuf bytes.Buffer
+
+	err := me.tmpl.Execute(&mdBuf, data)
+	if err != nil {
+		return err
+	}
+
+	return goldmark.Convert(mdBuf.Bytes(), wr)
+}
+
+func (me *markdownRenderer) Imports() []string {
+	return []string{`"text/template"`}
+}
+
+func (me *markdownRenderer) Compile(name, body string) string {
+	return fmt.Sprintf("aspen.NewMarkdownTemplate(template.Must(template.New(%s).Parse(%s)))",
+		name, body)
+}
+
+func (me *markdownRenderer) Validate(name, body string) error {
+	return validateTextTemplate(name, body)
+}
+
+func (me *markdownRenderer) ContentType() string {
+	return "text/html"
+}
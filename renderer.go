@@ -0,0 +1,160 @@
+package aspen
+
+import (
+	"fmt"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+const (
+	RendererGoTextTemplate = "go/text/template"
+	RendererGoHtmlTemplate = "go/html/template"
+)
+
+var (
+	renderers = map[string]Renderer{}
+)
+
+/*
+Renderer generates the Go source that compiles a simplate template page.
+
+Template pages select a renderer by name in their specline, e.g.
+"#!go/text/template".  The expression returned by Compile is written into the
+generated package, where it is evaluated once at package initialization and
+must yield an aspen.SimplateTemplate.  Additional engines may be made available
+to the site builder with RegisterRenderer before calling BuildMain.
+*/
+type Renderer interface {
+	// Imports returns the import specs needed by the expression returned from
+	// Compile, e.g. `"text/template"` or `htmltemplate "html/template"`.
+	Imports() []string
+
+	// Compile returns a Go expression of type aspen.SimplateTemplate.  Both
+	// name and body are given as Go string literals.
+	Compile(name, body string) string
+
+	// Validate parses the template body at build time, so that broken pages
+	// are reported before the generated package is written.  Errors that
+	// contain "name:line" are mapped to the line within the simplate.
+	Validate(name, body string) error
+}
+
+// ContentTypeRenderer may be implemented by renderers whose output has a
+// fixed media type, such as markdown rendered to HTML.  That media type is
+// used for rendered simplates in place of the one implied by the file
+// extension.
+type ContentTypeRenderer interface {
+	Renderer
+	ContentType() string
+}
+
+type goTemplateRenderer struct {
+	importSpec string
+	pkgName    string
+	validate   func(name, body string) error
+}
+
+func init() {
+	MustRegisterRenderer(RendererGoTextTemplate, &goTemplateRenderer{
+		importSpec: `"text/template"`,
+		pkgName:    "template",
+		validate:   validateTextTemplate,
+	})
+	MustRegisterRenderer(RendererGoHtmlTemplate, &goTemplateRenderer{
+		importSpec: `htmltemplate "html/template"`,
+		pkgName:    "htmltemplate",
+		validate:   validateHtmlTemplate,
+	})
+}
+
+// RegisterRenderer makes a renderer available to template pages under the
+// given name.  Registering the same name twice is an error.
+func RegisterRenderer(name string, renderer Renderer) error {
+	name = rendererName(name)
+	if len(name) == 0 {
+		return fmt.Errorf("Renderer name must be non-empty!")
+	}
+
+	if renderer == nil {
+		return fmt.Errorf("Renderer %q must be non-nil!", name)
+	}
+
+	if _, ok := renderers[name]; ok {
+		return fmt.Errorf("Renderer %q is already registered!", name)
+	}
+
+	debugf("Registering renderer %q: %+v", name, renderer)
+	renderers[name] = renderer
+	return nil
+}
+
+func MustRegisterRenderer(name string, renderer Renderer) {
+	err := RegisterRenderer(name, renderer)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// RendererNames returns the sorted names of all registered renderers.
+func RendererNames() []string {
+	names := []string{}
+	for name, _ := range renderers {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+func lookupRenderer(name string) (Renderer, error) {
+	name = rendererName(name)
+	if renderer, ok := renderers[name]; ok {
+		return renderer, nil
+	}
+
+	return nil, fmt.Errorf("Unknown renderer %q! Registered renderers are: %s",
+		name, strings.Join(RendererNames(), ", "))
+}
+
+// rendererName strips the optional "#!" prefix used in speclines.
+func rendererName(name string) string {
+	return strings.TrimPrefix(strings.TrimSpace(name), "#!")
+}
+
+func (me *goTemplateRenderer) Imports() []string {
+	return []string{me.importSpec}
+}
+
+func (me *goTemplateRenderer) Compile(name, body string) string {
+	return fmt.Sprintf("%s.Must(%s.New(%s).Parse(%s))",
+		me.pkgName, me.pkgName, name, body)
+}
+
+func (me *goTemplateRenderer) Validate(name, body string) error {
+	return me.validate(name, body)
+}
+
+func validateTextTemplate(name, body string) error {
+	_, err := template.New(name).Parse(body)
+	return err
+}
+
+func validateHtmlTemplate(name, body string) error {
+	tmpl, err := htmltemplate.New(name).Parse(body)
+	if err != nil {
+		return err
+	}
+
+	// html/template only escapes a template when it is first executed, so
+	// execute against no data to surface escaping errors, ignoring the
+	// execution errors that missing data causes.
+	err = tmpl.Execute(ioutil.Discard, nil)
+	if _, ok := err.(*htmltemplate.Error); ok {
+		return err
+	}
+
+	return nil
+}
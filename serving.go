@@ -26,7 +26,8 @@ func AddCommonServingOptions(serverBind,
 	debug, listDirs bool) {
 
 	optarg.Add("w", "www_root",
-		"Filesystem path of the document publishing root", wwwRoot)
+		"Filesystem path of the document publishing root, or of a zip or "+
+			"tar archive of it", wwwRoot)
 	optarg.Add("a", "network_address", "The IPv4 or IPv6 address to which "+
 		"the generated server will bind by default", serverBind)
 	optarg.Add("x", "debug", "Print debugging output", debug)
@@ -45,6 +46,10 @@ func AddCommonServingOptions(serverBind,
 func RunServerMain(wwwRoot, serverBind, packageName,
 	charsetDynamic, charsetStatic, indices string, listDirs, debug bool) {
 
+	// static files embedded in the generated package are served unless a
+	// www root, which may be an archive, is given explicitly
+	staticOnDisk := false
+
 	AddCommonServingOptions(serverBind,
 		wwwRoot, charsetDynamic, charsetStatic, indices, debug, listDirs)
 	for opt := range optarg.Parse() {
@@ -53,6 +58,7 @@ func RunServerMain(wwwRoot, serverBind, packageName,
 			serverBind = opt.String()
 		case "www_root":
 			wwwRoot = opt.String()
+			staticOnDisk = true
 		case "debug":
 			debug = opt.Bool()
 		case "charset_dynamic":
@@ -75,6 +81,11 @@ func RunServerMain(wwwRoot, serverBind, packageName,
 
 	debugf("Declaring app for package %q", packageName)
 	website := DeclareWebsite(packageName)
+	if staticOnDisk && website.StaticFS != nil {
+		debugf("Serving static files from %q instead of embedded files", wwwRoot)
+		website.SetStaticFS(nil)
+	}
+
 	website.Configure(serverBind, wwwRoot, charsetDynamic, charsetStatic,
 		indices, debug, listDirs)
 
@@ -1,13 +1,23 @@
 package aspen
 
 import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
 	"fmt"
+	"go/format"
+	"go/scanner"
 	"io"
 	"mime"
 	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"text/template"
+	"unicode"
+	"unicode/utf8"
 )
 
 const (
@@ -18,6 +28,15 @@ const (
 )
 
 var (
+	filenameEscapes = map[rune]string{
+		'.': "DOT",
+		'/': "SLASH",
+		' ': "SPACE",
+		'%': "PCT",
+		'-': "DASH",
+		'_': "UNDER",
+	}
+
 	SimplateTypes = []string{
 		SimplateTypeJson,
 		SimplateTypeNegotiated,
@@ -25,14 +44,25 @@ var (
 		SimplateTypeStatic,
 	}
 	simplateTypeTemplates = map[string]*template.Template{
-		SimplateTypeJson:       escapedSimplateTemplate(simplateTypeJSONTmpl, "aspen-gen-json"),
-		SimplateTypeRendered:   escapedSimplateTemplate(simplateTypeRenderedTmpl, "aspen-gen-rendered"),
-		SimplateTypeNegotiated: escapedSimplateTemplate(simplateTypeNegotiatedTmpl, "aspen-gen-negotiated"),
+		SimplateTypeJson:       newSimplateTemplate(simplateTypeJSONTmpl, "aspen-gen-json"),
+		SimplateTypeRendered:   newSimplateTemplate(simplateTypeRenderedTmpl, "aspen-gen-rendered"),
+		SimplateTypeNegotiated: newSimplateTemplate(simplateTypeNegotiatedTmpl, "aspen-gen-negotiated"),
 		SimplateTypeStatic:     nil,
 	}
-	defaultRenderer = "#!go/text/template"
+	speclineVia      = regexp.MustCompile(`(^|\s)via(\s|$)`)
+	pageBreakLine    = regexp.MustCompile(`(?m)^\[---+\]`)
+	defaultRenderer  = RendererGoTextTemplate
+	htmlRenderer     = RendererGoHtmlTemplate
+	htmlContentTypes = []string{"text/html", "application/xhtml+xml"}
 )
 
+// SimplateTemplate is the runtime form of a compiled template page, as
+// stored in the generated simplateTmplMap* variables.  Both text/template and
+// html/template satisfy it.
+type SimplateTemplate interface {
+	Execute(wr io.Writer, data interface{}) error
+}
+
 type simplate struct {
 	GenPackage    string
 	SiteRoot      string
@@ -43,17 +73,52 @@ type simplate struct {
 	InitPage      *simplatePage
 	LogicPage     *simplatePage
 	TemplatePages []*simplatePage
+	// hex SHA-1 of the source, or empty if it wasn't read
+	Hash string
+	// import path of aspen-go in the generated source;
+	// DefaultAspenImportPath if empty
+	AspenImportPath string
+
+	isolated bool
+	imports  []*importSpec
 }
 
 type simplatePage struct {
 	Parent *simplate
 	Body   string
 	Spec   *simplatePageSpec
+
+	// zero-based index of the page within the simplate source, or -1 for an
+	// omitted init page
+	Index int
+	// line and column within the simplate source on which Body begins
+	Line   int
+	Column int
+
+	renderer Renderer
+	// Body with the init page's declarations isolated, once generated
+	genBody string
+}
+
+// rawSimplatePage is a page of simplate source before it is parsed, along
+// with the position at which it begins.
+type rawSimplatePage struct {
+	Index   int
+	Line    int
+	Column  int
+	Content string
+
+	// length of the page break preceding the page
+	breakLen int
 }
 
 type simplatePageSpec struct {
 	ContentType string
-	Renderer    string
+	// media type parameters, e.g. charset, for negotiated pages
+	Params   map[string]string
+	Renderer string
+	// whether the specline named a media type for a rendered page
+	explicitType bool
 }
 
 func newSimplateFromString(packageName,
@@ -61,99 +126,110 @@ func newSimplateFromString(packageName,
 
 	debugf("Creating new simplate from string for "+
 		"SiteRoot:%q, Filename:%q", siteRoot, filename)
-	var err error
-	ext := path.Ext(filename)
-	hasExt := len(ext) > 0
+	hasExt := len(path.Ext(filename)) > 0
 
-	absFilename, err := filepath.Abs(filename)
+	s, err := newStaticSimplate(packageName, siteRoot, filename)
 	if err != nil {
 		return nil, err
 	}
 
-	filename, err = filepath.Rel(siteRoot, absFilename)
+	s.Hash = contentHash([]byte(content))
+
+	rawPages, err := splitRawPages(s.AbsFilename, content)
 	if err != nil {
 		return nil, err
 	}
 
-	rawPages := strings.Split(content, "")
+	absFilename := s.AbsFilename
 	nbreaks := len(rawPages) - 1
 
-	s := &simplate{
-		GenPackage:  packageName,
-		SiteRoot:    siteRoot,
-		Filename:    filename,
-		AbsFilename: absFilename,
-		Type:        SimplateTypeStatic,
-		ContentType: mime.TypeByExtension(ext),
-	}
-
 	debugf("Built proto-simplate for %q with %v line breaks %+v",
-		filename, nbreaks, s)
-
-	if nbreaks == 1 || nbreaks == 2 {
-		if !hasExt {
-			return nil, fmt.Errorf("1 or 2 ^L found in simplate %q! "+
-				"Rendered simplates must have a file extension!", filename)
-		}
+		s.Filename, nbreaks, s)
+
+	// Page counts follow Aspen: a single page is static; two pages are logic
+	// and template; three are init, logic and template.  More than three
+	// pages, or any pages in a file without an extension, make a negotiated
+	// resource whose template pages each declare their media type.  JSON
+	// simplates with two pages are init and logic, with no template.
+	if nbreaks == 0 {
+		debugf("Returning %v simplate %+v", s.Type, s)
+		return s, nil
+	}
 
-		s.InitPage, err = newSimplatePage(s, rawPages[0], false)
-		if err != nil {
-			return nil, err
-		}
+	if nbreaks > 2 && hasExt {
+		return nil, rawPages[3].breakError(absFilename,
+			SimplateErrorUnexpectedExtension, "More than 2 page breaks found in simplate! "+
+				"Negotiated simplates must not have a file extension!")
+	}
 
-		s.LogicPage, err = newSimplatePage(s, rawPages[1], false)
-		if err != nil {
-			return nil, err
-		}
+	initRawPage := &rawSimplatePage{Index: -1, Line: 1, Column: 1}
+	logicRawPage := rawPages[0]
+	templateRawPages := rawPages[1:]
 
-		if s.ContentType == "application/json" {
-			s.Type = SimplateTypeJson
-		} else {
-			s.Type = SimplateTypeRendered
-			templatePage, err := newSimplatePage(s, rawPages[2], true)
-			if err != nil {
-				return nil, err
-			}
+	isJson := s.ContentType == "application/json" && nbreaks == 1
+	if nbreaks > 1 || isJson {
+		initRawPage = rawPages[0]
+		logicRawPage = rawPages[1]
+		templateRawPages = rawPages[2:]
+	}
 
-			s.TemplatePages = append(s.TemplatePages, templatePage)
-		}
+	switch {
+	case !hasExt:
+		s.Type = SimplateTypeNegotiated
+	case isJson:
+		s.Type = SimplateTypeJson
+	default:
+		s.Type = SimplateTypeRendered
+	}
 
-		debugf("Returning %v simplate %+v", s.Type, s)
-		return s, nil
+	s.InitPage, err = newSimplatePage(s, initRawPage, false)
+	if err != nil {
+		return nil, err
 	}
 
-	if nbreaks > 2 {
-		if hasExt {
-			return nil, fmt.Errorf("More than 2 ^L found in simplate %q! "+
-				"Negotiated simplates must not have a file extension!", filename)
-		}
+	s.LogicPage, err = newSimplatePage(s, logicRawPage, false)
+	if err != nil {
+		return nil, err
+	}
 
-		s.Type = SimplateTypeNegotiated
-		s.InitPage, err = newSimplatePage(s, rawPages[0], false)
+	for _, rawPage := range templateRawPages {
+		templatePage, err := newSimplatePage(s, rawPage, true)
 		if err != nil {
 			return nil, err
 		}
 
-		s.LogicPage, err = newSimplatePage(s, rawPages[1], false)
-		if err != nil {
-			return nil, err
-		}
+		s.TemplatePages = append(s.TemplatePages, templatePage)
+	}
 
-		for _, rawPage := range rawPages[2:] {
-			templatePage, err := newSimplatePage(s, rawPage, true)
-			if err != nil {
-				return nil, err
-			}
+	debugf("Returning %v simplate %+v", s.Type, s)
+	return s, nil
+}
 
-			s.TemplatePages = append(s.TemplatePages, templatePage)
-		}
+// newStaticSimplate makes a static simplate without reading the file, as is
+// done for binary files and files that can't be simplates.
+func newStaticSimplate(packageName, siteRoot, filename string) (*simplate, error) {
+	absFilename, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, err
+	}
 
-		debugf("Returning %v simplate %+v", s.Type, s)
-		return s, nil
+	relFilename, err := filepath.Rel(siteRoot, absFilename)
+	if err != nil {
+		return nil, err
 	}
 
-	debugf("Returning %v simplate %+v", s.Type, s)
-	return s, nil
+	return &simplate{
+		GenPackage:  packageName,
+		SiteRoot:    siteRoot,
+		Filename:    relFilename,
+		AbsFilename: absFilename,
+		Type:        SimplateTypeStatic,
+		ContentType: mime.TypeByExtension(path.Ext(filename)),
+	}, nil
+}
+
+func contentHash(content []byte) string {
+	return fmt.Sprintf("%x", sha1.Sum(content))
 }
 
 func (me *simplate) FirstTemplatePage() *simplatePage {
@@ -164,6 +240,58 @@ func (me *simplate) FirstTemplatePage() *simplatePage {
 	return nil
 }
 
+// TemplateImports returns the sorted, de-duplicated import specs needed by the
+// renderers of all template pages.
+func (me *simplate) TemplateImports() []string {
+	seen := map[string]bool{}
+	imports := []string{}
+
+	for _, page := range me.TemplatePages {
+		for _, spec := range page.renderer.Imports() {
+			if !seen[spec] {
+				seen[spec] = true
+				imports = append(imports, spec)
+			}
+		}
+	}
+
+	sort.Strings(imports)
+	return imports
+}
+
+// pageIndexAt returns the index of the page containing the given line of the
+// simplate source, or -1 if there is none.
+func (me *simplate) pageIndexAt(line int) int {
+	index := -1
+	pages := append([]*simplatePage{me.InitPage, me.LogicPage}, me.TemplatePages...)
+
+	for _, page := range pages {
+		if page != nil && page.Index > -1 && page.Line <= line {
+			index = page.Index
+		}
+	}
+
+	return index
+}
+
+// ValidateTemplates parses every template page, returning a MultiError of
+// every page that fails.
+func (me *simplate) ValidateTemplates() error {
+	errs := MultiError{}
+	for _, page := range me.TemplatePages {
+		serr := page.validateTemplate()
+		if serr != nil {
+			errs = append(errs, serr)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
 func (me *simplate) Execute(wr io.Writer) (err error) {
 	defer func(err *error) {
 		r := recover()
@@ -173,18 +301,182 @@ func (me *simplate) Execute(wr io.Writer) (err error) {
 	}(&err)
 
 	debugf("Executing to %+v\n", wr)
-	*(&err) = simplateTypeTemplates[me.Type].Execute(wr, me)
+	me.isolateDeclarations()
+
+	var genBuf bytes.Buffer
+	err = simplateTypeTemplates[me.Type].Execute(&genBuf, me)
+	if err != nil {
+		return
+	}
+
+	_, err = wr.Write(me.fixGenLineDirectives(genBuf.Bytes()))
 	return
 }
 
+// formatSource gofmts the generated source of the simplate, then fixes up the
+// line directives that formatting moved.
+func (me *simplate) formatSource(src []byte) ([]byte, error) {
+	formatted, err := format.Source(src)
+	if err == nil {
+		formatted = fixPageLineDirectives(src, formatted, me.AbsFilename)
+		return me.fixGenLineDirectives(formatted), nil
+	}
+
+	// line directives point most errors back into the simplate
+	page, line, column := -1, 0, 0
+	if list, ok := err.(scanner.ErrorList); ok && len(list) > 0 {
+		if list[0].Pos.Filename == me.AbsFilename {
+			page, line, column = me.pageIndexAt(list[0].Pos.Line),
+				list[0].Pos.Line, list[0].Pos.Column
+		}
+		err = errors.New(list[0].Msg)
+	}
+
+	return nil, newSimplateError(me.AbsFilename, page, line, column,
+		SimplateErrorCodegen, "Generated source can't be formatted! %v", err)
+}
+
+// GenLineDirective is written after each simplate page in generated source
+// to point positions back at the generated file itself.  The line number is
+// a placeholder until fixed by fixGenLineDirectives.
+func (me *simplate) GenLineDirective() string {
+	return fmt.Sprintf("//line %s:1:1", me.OutputName())
+}
+
+func (me *simplate) fixGenLineDirectives(src []byte) []byte {
+	return fixGenLineDirectives(src, me.OutputName())
+}
+
+func fixGenLineDirectives(src []byte, outputName string) []byte {
+	prefix := []byte(fmt.Sprintf("//line %s:", outputName))
+	lines := bytes.Split(src, []byte("\n"))
+
+	for i, line := range lines {
+		if bytes.HasPrefix(line, prefix) {
+			// the directive applies to the line after it, which is
+			// line number i+2 since i is zero-based.
+			lines[i] = []byte(fmt.Sprintf("%s%d:1", prefix, i+2))
+		}
+	}
+
+	return bytes.Join(lines, []byte("\n"))
+}
+
+/*
+fixPageLineDirectives keeps the lines of formatted source that follow each
+line directive into the simplate at filename mapped to the simplate lines
+they came from.  Formatting collapses runs of blank lines, so wherever lines
+have been dropped since the directive, another directive is inserted before
+the next non-blank line.  Formatting otherwise keeps the line breaks between
+tokens, so the non-blank lines of src and formatted correspond one-to-one.
+*/
+func fixPageLineDirectives(src, formatted []byte, filename string) []byte {
+	prefix := fmt.Sprintf("//line %s:", filename)
+	srcRegions := pageLineRegions(bytes.Split(src, []byte("\n")), prefix)
+	lines := bytes.Split(formatted, []byte("\n"))
+	regions := pageLineRegions(lines, prefix)
+	if len(regions) != len(srcRegions) {
+		return formatted
+	}
+
+	fixed := [][]byte{}
+	next := 0
+	for i, region := range regions {
+		fixed = append(fixed, lines[next:region.start]...)
+		next = region.start + len(region.lines)
+
+		srcLine := srcRegions[i].line
+		srcLines := srcRegions[i].lines
+		k := 0
+		mappedLine := region.line
+		for _, line := range region.lines {
+			if len(bytes.TrimSpace(line)) > 0 {
+				for k < len(srcLines) && len(bytes.TrimSpace(srcLines[k])) == 0 {
+					k++
+				}
+
+				if k < len(srcLines) && mappedLine != srcLine+k {
+					mappedLine = srcLine + k
+					fixed = append(fixed, []byte(fmt.Sprintf("%s%d", prefix, mappedLine)))
+				}
+				k++
+			}
+
+			fixed = append(fixed, line)
+			mappedLine++
+		}
+	}
+
+	fixed = append(fixed, lines[next:]...)
+	return bytes.Join(fixed, []byte("\n"))
+}
+
+// pageLineRegion is a run of generated source lines following a line
+// directive into a simplate, up to the next line directive of any kind.
+type pageLineRegion struct {
+	// index of the first line after the directive
+	start int
+	// simplate line number of the first line
+	line  int
+	lines [][]byte
+}
+
+func pageLineRegions(lines [][]byte, prefix string) []*pageLineRegion {
+	regions := []*pageLineRegion{}
+	var region *pageLineRegion
+
+	for i, line := range lines {
+		if bytes.HasPrefix(line, []byte("//line ")) {
+			region = nil
+			if bytes.HasPrefix(line, []byte(prefix)) {
+				lineNum := strings.SplitN(string(line[len(prefix):]), ":", 2)[0]
+				n, err := strconv.Atoi(lineNum)
+				if err == nil {
+					region = &pageLineRegion{start: i + 1, line: n}
+					regions = append(regions, region)
+				}
+			}
+			continue
+		}
+
+		if region != nil {
+			region.lines = append(region.lines, line)
+		}
+	}
+
+	return regions
+}
+
+/*
+escapedFilename maps the simplate's filename onto letters, digits and "-",
+such that distinct filenames never share an escaped form.  Letters and digits
+are kept, while every other character becomes a "-NAME-" token: "-DOT-",
+"-SLASH-", "-SPACE-", "-PCT-", "-DASH-" and "-UNDER-" for ".", "/", " ", "%",
+"-" and "_", or "-U<hex>-" with the character's code point otherwise.  As
+token names contain no "-" and tokens are never collapsed, the escaped form
+can always be read back.
+*/
 func (me *simplate) escapedFilename() string {
-	fn := filepath.Clean(me.Filename)
-	lessDots := strings.Replace(fn, ".", "-DOT-", -1)
-	lessSlashes := strings.Replace(lessDots, "/", "-SLASH-", -1)
-	lessSpaces := strings.Replace(lessSlashes, " ", "-SPACE-", -1)
-	lessPercents := strings.Replace(lessSpaces, "%", "-PCT-", -1)
-	squeaky := nonAlNumDash.ReplaceAllString(lessPercents, "-")
-	return strings.Replace(squeaky, "--", "-", -1)
+	var buf bytes.Buffer
+
+	for _, r := range filepath.ToSlash(filepath.Clean(me.Filename)) {
+		switch {
+		case r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+			buf.WriteRune(r)
+		case len(filenameEscapes[r]) > 0:
+			buf.WriteString("-" + filenameEscapes[r] + "-")
+		default:
+			fmt.Fprintf(&buf, "-U%X-", r)
+		}
+	}
+
+	return buf.String()
+}
+
+// RequestPath is the path under which the simplate is served, and under which
+// it is recorded in the site index.
+func (me *simplate) RequestPath() string {
+	return "/" + filepath.ToSlash(me.Filename)
 }
 
 func (me *simplate) OutputName() string {
@@ -195,85 +487,266 @@ func (me *simplate) OutputName() string {
 	return me.escapedFilename() + ".go"
 }
 
+// FuncName is the identifier, unique within the generated package, from which
+// the names of the simplate's handler func and other globals are made.  It is
+// the escaped filename with "-" replaced by "_", which can't otherwise occur,
+// and a leading "_" if it would begin with a digit.
 func (me *simplate) FuncName() string {
-	escaped := me.escapedFilename()
-	parts := strings.Split(escaped, "-")
-	for i, part := range parts {
-		var capitalized []string
-		capitalized = append(capitalized, strings.ToUpper(string(part[0])))
-		capitalized = append(capitalized, strings.ToLower(part[1:]))
-		parts[i] = strings.Join(capitalized, "")
+	ident := strings.Replace(me.escapedFilename(), "-", "_", -1)
+	if len(ident) > 0 && ident[0] >= '0' && ident[0] <= '9' {
+		ident = "_" + ident
 	}
 
-	return strings.Join(parts, "")
+	return ident
 }
 
+// ConstName is an exported identifier for a constant naming the simplate,
+// unique as FuncName is.
 func (me *simplate) ConstName() string {
-	escaped := me.escapedFilename()
-	uppered := strings.ToUpper(escaped)
-	return strings.Replace(uppered, "-", "_", -1)
+	return "SIMPLATE_" + strings.Replace(me.escapedFilename(), "-", "_", -1)
 }
 
 func newSimplatePageSpec(simplate *simplate, specline string) (*simplatePageSpec, error) {
 	sps := &simplatePageSpec{
 		ContentType: simplate.ContentType,
-		Renderer:    defaultRenderer,
+		Renderer:    defaultRendererFor(simplate.ContentType),
 	}
 
-	switch simplate.Type {
-	case SimplateTypeStatic:
+	if simplate.Type == SimplateTypeStatic {
 		return &simplatePageSpec{}, nil
+	}
+
+	mediaType, params, renderer, err := parseSpecline(specline)
+	if err != nil {
+		return nil, err
+	}
+
+	switch simplate.Type {
 	case SimplateTypeJson:
 		return sps, nil
 	case SimplateTypeRendered:
-		renderer := specline
-		if len(renderer) < 1 {
-			renderer = defaultRenderer
+		if len(mediaType) > 0 {
+			extType, _, err := mime.ParseMediaType(simplate.ContentType)
+			if err == nil && extType != mediaType {
+				return nil, fmt.Errorf("Media type %q in specline doesn't match %q "+
+					"implied by the file extension!", mediaType, extType)
+			}
+
+			// keep the bare media type for negotiation, as negotiated pages do
+			sps.ContentType = mediaType
+			sps.Params = params
+			sps.explicitType = true
+		}
+	case SimplateTypeNegotiated:
+		if len(mediaType) == 0 {
+			return nil, fmt.Errorf("A negotiated resource specline must name a "+
+				"media type, as in \"media/type via renderer\". Yours is %q", specline)
 		}
 
+		// only the bare media type takes part in negotiation; parameters are
+		// sent along in the response's Content-Type
+		sps.ContentType = mediaType
+		sps.Params = params
+		sps.Renderer = defaultRendererFor(mediaType)
+	default:
+		return nil, fmt.Errorf("Can't make a page spec "+
+			"for simplate type %q", simplate.Type)
+	}
+
+	if len(renderer) > 0 {
 		sps.Renderer = renderer
-		return sps, nil
-	case SimplateTypeNegotiated:
-		parts := strings.Fields(specline)
-		nParts := len(parts)
+	}
 
-		if nParts < 1 || nParts > 2 {
-			return nil, fmt.Errorf("A negotiated resource specline "+
-				"must have one or two parts: #!renderer media/type. Yours is %q",
-				specline)
+	return sps, nil
+}
+
+/*
+parseSpecline splits a template page's specline according to the Aspen
+grammar, in which either part may be omitted:
+
+	media/type via renderer
+
+Media types may carry parameters, e.g. "text/html; charset=utf-8 via
+markdown".  The older "media/type #!renderer" form is also accepted.
+*/
+func parseSpecline(specline string) (mediaType string,
+	params map[string]string, renderer string, err error) {
+
+	media := specline
+	if loc := speclineVia.FindStringIndex(specline); loc != nil {
+		media = specline[:loc[0]]
+		fields := strings.Fields(specline[loc[1]:])
+		if len(fields) == 0 {
+			return "", nil, "", fmt.Errorf("Specline %q names no renderer "+
+				"after \"via\"!", specline)
 		}
 
-		if nParts == 1 {
-			sps.ContentType = parts[0]
-			sps.Renderer = defaultRenderer
-			return sps, nil
-		} else {
-			sps.ContentType = parts[0]
-			sps.Renderer = parts[1]
-			return sps, nil
+		if len(fields) > 1 {
+			return "", nil, "", fmt.Errorf("Unexpected %q after renderer %q "+
+				"in specline %q!", strings.Join(fields[1:], " "), fields[0], specline)
+		}
+
+		renderer = rendererName(fields[0])
+	} else {
+		fields := strings.Fields(specline)
+		for i, field := range fields {
+			if !strings.HasPrefix(field, "#!") {
+				continue
+			}
+
+			if i != len(fields)-1 {
+				return "", nil, "", fmt.Errorf("Unexpected %q after renderer %q "+
+					"in specline %q!", strings.Join(fields[i+1:], " "), field, specline)
+			}
+
+			media = strings.Join(fields[:i], " ")
+			renderer = rendererName(field)
 		}
 	}
 
-	return nil, fmt.Errorf("Can't make a page spec "+
-		"for simplate type %q", simplate.Type)
+	media = strings.TrimSpace(media)
+	if len(media) == 0 {
+		return "", nil, renderer, nil
+	}
+
+	mediaType, params, err = mime.ParseMediaType(media)
+	if err != nil {
+		return "", nil, "", fmt.Errorf("Invalid media type %q in specline: %v",
+			media, err)
+	}
+
+	if !strings.Contains(mediaType, "/") || strings.HasSuffix(mediaType, "/") {
+		return "", nil, "", fmt.Errorf("Media type %q in specline must be "+
+			"of the form type/subtype!", media)
+	}
+
+	return mediaType, params, renderer, nil
+}
+
+// MediaType is the page's content type along with any media type parameters
+// given in its specline, as sent in the Content-Type header.
+func (me *simplatePageSpec) MediaType() string {
+	if len(me.Params) == 0 {
+		return me.ContentType
+	}
+
+	return mime.FormatMediaType(me.ContentType, me.Params)
 }
 
-func newSimplatePage(simplate *simplate, rawPage string, needsSpec bool) (*simplatePage, error) {
+// splitRawPages splits simplate source on page breaks, keeping track of the
+// line and column on which each page begins.  Pages may be separated by ^L
+// or, as in current Aspen, by a line beginning with "[---]", but not both.
+func splitRawPages(filename, content string) ([]*rawSimplatePage, error) {
+	formFeedBreaks := [][]int{}
+	for i, r := range content {
+		if r == '\x0c' {
+			formFeedBreaks = append(formFeedBreaks, []int{i, i + 1})
+		}
+	}
+
+	breaks := pageBreakLine.FindAllStringIndex(content, -1)
+
+	if len(formFeedBreaks) > 0 && len(breaks) > 0 {
+		mixedAt := formFeedBreaks[0][0]
+		if breaks[0][0] > mixedAt {
+			mixedAt = breaks[0][0]
+		}
+
+		line, column := offsetPosition(content, mixedAt)
+		return nil, newSimplateError(filename, -1, line, column,
+			SimplateErrorMixedPageBreaks, "Simplate mixes ^L and [---] page "+
+				"breaks! Use one or the other.")
+	}
+
+	if len(formFeedBreaks) > 0 {
+		breaks = formFeedBreaks
+	}
+
+	rawPages := []*rawSimplatePage{}
+	start, line, column, breakLen := 0, 1, 1, 0
+
+	for i := 0; i <= len(breaks); i++ {
+		end := len(content)
+		if i < len(breaks) {
+			end = breaks[i][0]
+		}
+
+		rawPages = append(rawPages, &rawSimplatePage{
+			Index:   i,
+			Line:    line,
+			Column:  column,
+			Content: content[start:end],
+
+			breakLen: breakLen,
+		})
+
+		if i < len(breaks) {
+			start = breaks[i][1]
+			breakLen = breaks[i][1] - breaks[i][0]
+			line, column = offsetPosition(content, start)
+		}
+	}
+
+	return rawPages, nil
+}
+
+// offsetPosition returns the one-based line and column of a byte offset.
+func offsetPosition(content string, offset int) (int, int) {
+	line := 1 + strings.Count(content[:offset], "\n")
+	column := offset - strings.LastIndex(content[:offset], "\n")
+	return line, column
+}
+
+// breakError builds an error located at the page break preceding this page.
+func (me *rawSimplatePage) breakError(filename, code, format string,
+	v ...interface{}) *SimplateError {
+
+	return newSimplateError(filename, me.Index, me.Line, me.Column-me.breakLen,
+		code, format, v...)
+}
+
+// defaultRendererFor picks the renderer used when a template page's specline
+// doesn't name one.  HTML pages get html/template so that their output is
+// contextually autoescaped; everything else gets text/template.
+func defaultRendererFor(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.TrimSpace(strings.Split(contentType, ";")[0])
+	}
+
+	for _, htmlType := range htmlContentTypes {
+		if strings.EqualFold(mediaType, htmlType) {
+			return htmlRenderer
+		}
+	}
+
+	return defaultRenderer
+}
+
+func newSimplatePage(simplate *simplate, rawPage *rawSimplatePage,
+	needsSpec bool) (*simplatePage, error) {
+
 	spec := &simplatePageSpec{}
 	var err error
 
 	specline := ""
-	body := rawPage
+	body := rawPage.Content
+	line, column := rawPage.Line, rawPage.Column
 
 	if needsSpec {
-		parts := strings.SplitN(rawPage, "\n", 2)
+		parts := strings.SplitN(rawPage.Content, "\n", 2)
 		specline = parts[0]
-		body = parts[1]
+		body = ""
+		if len(parts) > 1 {
+			body = parts[1]
+		}
+		line, column = line+1, 1
 
 		spec, err = newSimplatePageSpec(simplate,
 			strings.TrimSpace(strings.Replace(specline, "", "", -1)))
 		if err != nil {
-			return nil, err
+			return nil, newSimplateError(simplate.AbsFilename, rawPage.Index,
+				rawPage.Line, rawPage.Column, SimplateErrorInvalidSpecline, "%v", err)
 		}
 	}
 
@@ -281,6 +754,83 @@ func newSimplatePage(simplate *simplate, rawPage string, needsSpec bool) (*simpl
 		Parent: simplate,
 		Body:   body,
 		Spec:   spec,
+		Index:  rawPage.Index,
+		Line:   line,
+		Column: column,
 	}
+
+	if needsSpec {
+		sp.renderer, err = lookupRenderer(spec.Renderer)
+		if err != nil {
+			return nil, newSimplateError(simplate.AbsFilename, rawPage.Index,
+				rawPage.Line, rawPage.Column, SimplateErrorUnknownRenderer, "%v", err)
+		}
+
+		if simplate.Type == SimplateTypeRendered {
+			simplate.ContentType = spec.ContentType
+		}
+
+		ctr, ok := sp.renderer.(ContentTypeRenderer)
+		if ok && simplate.Type == SimplateTypeRendered && !spec.explicitType {
+			spec.ContentType = ctr.ContentType()
+			simplate.ContentType = spec.ContentType
+		}
+	}
+
 	return sp, nil
 }
+
+// LineDirective points positions in the generated source that follows it
+// back at the simplate page.  Template bodies begin mid-line in generated
+// source, so only Go pages get a column.
+func (me *simplatePage) LineDirective() string {
+	if me.renderer != nil {
+		return fmt.Sprintf("//line %s:%d", me.Parent.AbsFilename, me.Line)
+	}
+
+	return fmt.Sprintf("//line %s:%d:%d", me.Parent.AbsFilename, me.Line, me.Column)
+}
+
+// GenBody is the page body as generated, which for init and logic pages has
+// the init page's declarations renamed by isolateDeclarations.
+func (me *simplatePage) GenBody() string {
+	if me.Parent != nil && me.Parent.isolated && me.renderer == nil {
+		return me.genBody
+	}
+
+	return me.Body
+}
+
+// TemplateExpr is the Go expression, built by the page's renderer, that
+// compiles this page in the generated package.
+func (me *simplatePage) TemplateExpr() string {
+	name := strconv.Quote(me.TemplateName())
+	return me.renderer.Compile(name, goStringLiteral(me.Body))
+}
+
+// TemplateName is the name under which the page's template is parsed, both
+// when validating at build time and in the generated package.
+func (me *simplatePage) TemplateName() string {
+	return me.Parent.FuncName() + "!" + me.Spec.ContentType
+}
+
+// validateTemplate parses the page with its renderer, mapping any error
+// that refers to a line within the template back to the simplate source.
+func (me *simplatePage) validateTemplate() *SimplateError {
+	name := me.TemplateName()
+	err := me.renderer.Validate(name, me.Body)
+	if err == nil {
+		return nil
+	}
+
+	line := me.Line
+	linePattern := regexp.MustCompile(regexp.QuoteMeta(name) + `:(\d+)`)
+	match := linePattern.FindStringSubmatch(err.Error())
+	if match != nil {
+		tmplLine, _ := strconv.Atoi(match[1])
+		line += tmplLine - 1
+	}
+
+	return newSimplateError(me.Parent.AbsFilename, me.Index, line, 0,
+		SimplateErrorInvalidTemplate, "%v", err)
+}
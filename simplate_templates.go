@@ -1,8 +1,10 @@
 package aspen
 
 import (
+	"strconv"
 	"strings"
 	"text/template"
+	"unicode/utf8"
 )
 
 var (
@@ -15,34 +17,31 @@ package {{.GenPackage}}
 //
 // Rebuild with aspen-build!
 
-import (
-    "net/http"
-
-    "github.com/zetaweb/aspen-go"
-)
-
+{{.ImportDecl}}
 `
 	simplateTmplWebFuncDeclaration = `
     local{{.FuncName}}Website = aspen.DeclareWebsite("{{.GenPackage}}")
 
     _ = local{{.FuncName}}Website.RegisterSimplate("{{.Type}}",
-        "{{.SiteRoot}}",
-        "/{{.Filename}}",
+        {{goString .SiteRoot}},
+        {{goString (print "/" .Filename)}},
         SimplateHandlerFunc{{.FuncName}})
 `
 	simplateTmplFuncHeader = `
 func SimplateHandlerFunc{{.FuncName}}(w http.ResponseWriter, request *http.Request) {
     var err error
     website := local{{.FuncName}}Website
-    website.DebugNewRequest("{{.AbsFilename}}", request)
+    website.DebugNewRequest({{goString .AbsFilename}}, request)
 
     response := website.NewHTTPResponseWrapper(w, request)
 
-    __file__ := "{{.AbsFilename}}"
+    __file__ := {{goString .AbsFilename}}
     ctx := map[string]interface{}{}
-    website.UpdateContextFromVirtualPaths(&ctx, request.URL.Path, "/{{.Filename}}")
+    website.UpdateContextFromVirtualPaths(&ctx, request.URL.Path, {{goString (print "/" .Filename)}})
 
-    {{.LogicPage.Body}}
+{{.LogicPage.LineDirective}}
+{{.LogicPage.GenBody}}
+{{.GenLineDirective}}
 `
 	simplateTmplFuncFooter = `
     response.NegotiateAndCallHandler()
@@ -54,19 +53,18 @@ func SimplateHandlerFunc{{.FuncName}}(w http.ResponseWriter, request *http.Reque
 `
 
 	simplateTypeRenderedTmpl = simplateTmplCommonHeader + `
-import (
-    "bytes"
-    "text/template"
-)
-
-{{.InitPage.Body}}
+{{.InitPage.LineDirective}}
+{{.InitPage.GenBody}}
+{{.GenLineDirective}}
 
 var (
     _ = aspen.EnsureInitialized()
 
-    simplateTmplMap{{.FuncName}} = map[string]*template.Template{
+    simplateTmplMap{{.FuncName}} = map[string]aspen.SimplateTemplate{
         {{range .TemplatePages}}
-        "{{.Spec.ContentType}}": template.Must(template.New("{{.Parent.FuncName}}!{{.Spec.ContentType}}").Parse(__BACKTICK__{{.Body}}__BACKTICK__)),
+{{.LineDirective}}
+        {{goString .Spec.ContentType}}: {{.TemplateExpr}},
+{{.Parent.GenLineDirective}}
         {{end}}
     }
 
@@ -76,9 +74,9 @@ var (
 ` + simplateTmplFuncHeader + `
 
     {{range .TemplatePages}}
-    response.RegisterContentTypeHandler("{{.Spec.ContentType}}",
+    response.RegisterContentTypeHandler({{goString .Spec.ContentType}},
         func(response *aspen.HTTPResponseWrapper) {
-            tmpl := simplateTmplMap{{.Parent.FuncName}}["{{.Spec.ContentType}}"]
+            tmpl := simplateTmplMap{{.Parent.FuncName}}[{{goString .Spec.ContentType}}]
             var tmplBuf bytes.Buffer
 
             err = tmpl.Execute(&tmplBuf, ctx)
@@ -87,7 +85,7 @@ var (
                 return
             }
 
-            response.SetContentType("{{.Spec.ContentType}}")
+            response.SetContentType({{goString .Spec.MediaType}})
             response.SetBodyBytes(tmplBuf.Bytes())
         })
     {{end}}
@@ -97,7 +95,9 @@ var (
 }
 `
 	simplateTypeJSONTmpl = simplateTmplCommonHeader + `
-{{.InitPage.Body}}
+{{.InitPage.LineDirective}}
+{{.InitPage.GenBody}}
+{{.GenLineDirective}}
 
 var (
     _ = aspen.EnsureInitialized()
@@ -112,8 +112,24 @@ var (
 	simplateTypeNegotiatedTmpl = simplateTypeRenderedTmpl
 )
 
-func escapedSimplateTemplate(tmplString, name string) *template.Template {
-	tmpl := template.New(name)
-	escTmplString := strings.Replace(tmplString, "__BACKTICK__", "`", -1)
-	return template.Must(tmpl.Parse(escTmplString))
+func newSimplateTemplate(tmplString, name string) *template.Template {
+	tmpl := template.New(name).Funcs(template.FuncMap{
+		"goString": goStringLiteral,
+	})
+	return template.Must(tmpl.Parse(tmplString))
+}
+
+// goStringLiteral quotes arbitrary content as a Go string literal.  Raw
+// strings keep template bodies readable in generated source, but can't hold
+// backticks, carriage returns, NUL bytes, byte order marks or invalid UTF-8,
+// and a line that looks like a //line directive would be mistaken for one
+// when fixing up generated line directives, so those get an interpreted
+// string literal instead.
+func goStringLiteral(s string) string {
+	if utf8.ValidString(s) && !strings.ContainsAny(s, "`\r\x00\ufeff") &&
+		!strings.Contains(s, "\n//line ") {
+		return "`" + s + "`"
+	}
+
+	return strconv.Quote(s)
 }
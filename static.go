@@ -4,7 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
-	"io/ioutil"
+	"io/fs"
 	"mime"
 	"net/http"
 	"os"
@@ -40,9 +40,6 @@ func (me *websiteStaticHandler) NextHandler() pipelineHandler {
 func (me *websiteStaticHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	debugf("Handling static request for %q", req.URL.Path)
 
-	fullPath := path.Join(me.w.WwwRoot, strings.TrimLeft(req.URL.Path, "/"))
-	req.Header.Set(pathTransHeader, fullPath)
-
 	err := me.serveStatic(w, req)
 	if err == nil {
 		return
@@ -74,31 +71,38 @@ func (me *websiteStaticHandler) String() string {
 }
 
 func (me *websiteStaticHandler) serveStatic(w http.ResponseWriter, req *http.Request) error {
-	fullPath, err := me.findStaticPath(req)
+	fsys := me.w.staticFS()
+
+	name, err := me.findStaticName(fsys, req)
 	if err != nil {
 		return err
 	}
 
-	debugf("Found static path %q from root %q and request path %q",
-		fullPath, me.w.WwwRoot, req.URL.Path)
+	debugf("Found static file %q from root %q and request path %q",
+		name, me.w.WwwRoot, req.URL.Path)
 
-	fi, err := os.Stat(fullPath)
+	fi, err := fs.Stat(fsys, name)
 	if err != nil {
 		return err
 	}
 
+	if me.w.isIgnored(name, fi.IsDir()) {
+		debugf("Refusing to serve ignored path %q", name)
+		return fs.ErrNotExist
+	}
+
 	if fi.IsDir() {
-		return &serveDirError{Path: fullPath}
+		return &serveDirError{Path: name}
 	}
 
-	ctype := mime.TypeByExtension(path.Ext(fullPath))
+	ctype := mime.TypeByExtension(path.Ext(name))
 	if strings.HasPrefix(ctype, "text/") && !strings.Contains(ctype, "charset=") {
 		ctype = fmt.Sprintf("%v; charset=utf-8", ctype)
 	}
 
-	outf, err := os.Open(fullPath)
+	outf, err := fsys.Open(name)
 	if err != nil {
-		debugf("Could not open %q", fullPath)
+		debugf("Could not open %q", name)
 		return err
 	}
 
@@ -117,21 +121,23 @@ func (me *websiteStaticHandler) serveDirListing(w http.ResponseWriter,
 
 	debugf("Serving directory listing for %q", req.URL.Path)
 
-	fullPath := req.Header.Get(pathTransHeader)
-	if len(fullPath) == 0 {
-		fullPath = path.Join(me.w.WwwRoot, strings.TrimLeft(req.URL.Path, "/"))
-	}
+	fsys := me.w.staticFS()
+	name := staticName(req.URL.Path)
 
-	fi, err := os.Stat(fullPath)
+	fi, err := fs.Stat(fsys, name)
 	if err != nil {
 		return err
 	}
 
 	if !fi.IsDir() {
-		return fmt.Errorf("%q is not a directory!", fullPath)
+		return fmt.Errorf("%q is not a directory!", name)
 	}
 
-	dirListing, err := newDirListing(req.URL.Path, fullPath)
+	if me.w.isIgnored(name, true) {
+		return fs.ErrNotExist
+	}
+
+	dirListing, err := newDirListing(req.URL.Path, name, me.w)
 	if err != nil {
 		return err
 	}
@@ -150,20 +156,19 @@ func (me *websiteStaticHandler) serveDirListing(w http.ResponseWriter,
 	return nil
 }
 
-func (me *websiteStaticHandler) findStaticPath(req *http.Request) (string, error) {
-	fullPath := req.Header.Get(pathTransHeader)
-	if len(fullPath) == 0 {
-		fullPath = path.Join(me.w.WwwRoot, strings.TrimLeft(req.URL.Path, "/"))
-	}
+// findStaticName returns the name within fsys of the file to serve for the
+// request, which is an index file when a directory with one is requested.
+func (me *websiteStaticHandler) findStaticName(fsys fs.FS, req *http.Request) (string, error) {
+	name := staticName(req.URL.Path)
 
-	fi, err := os.Stat(fullPath)
-	if _, ok := err.(*os.PathError); ok {
-		debugf("Failed to stat %q: %v", fullPath, err)
+	fi, err := fs.Stat(fsys, name)
+	if err != nil {
+		debugf("Failed to stat %q: %v", name, err)
 		return "", err
 	}
 
 	if fi.IsDir() {
-		debugf("%q is a directory", fullPath)
+		debugf("%q is a directory", name)
 		debugf("Looking for candidate index files.  Configured indices = %+v",
 			me.w.Indices)
 
@@ -172,24 +177,34 @@ func (me *websiteStaticHandler) findStaticPath(req *http.Request) (string, error
 				continue
 			}
 
-			tryFullPath := path.Join(fullPath, idx)
+			tryName := path.Join(name, idx)
 
-			debugf("Checking for candidate index file at %q", tryFullPath)
-			fi, err := os.Stat(tryFullPath)
+			debugf("Checking for candidate index file at %q", tryName)
+			fi, err := fs.Stat(fsys, tryName)
 			if err != nil || fi.IsDir() {
 				continue
 			}
 
-			debugf("Found candidate index file at %q", tryFullPath)
-			return tryFullPath, nil
+			debugf("Found candidate index file at %q", tryName)
+			return tryName, nil
 		}
 	}
 
-	return fullPath, nil
+	return name, nil
 }
 
-func newDirListing(requestPath, dirPath string) (*directoryListing, error) {
-	entries, err := ioutil.ReadDir(dirPath)
+// staticName converts a request path to a name within a static file system.
+func staticName(requestPath string) string {
+	name := strings.TrimLeft(path.Clean("/"+requestPath), "/")
+	if len(name) == 0 {
+		return "."
+	}
+
+	return name
+}
+
+func newDirListing(requestPath, name string, w *Website) (*directoryListing, error) {
+	entries, err := fs.ReadDir(w.staticFS(), name)
 	if err != nil {
 		return nil, err
 	}
@@ -197,6 +212,15 @@ func newDirListing(requestPath, dirPath string) (*directoryListing, error) {
 	dlEntries := []*directoryListingEntry{}
 
 	for _, ent := range entries {
+		if w.isIgnored(path.Join(name, ent.Name()), ent.IsDir()) {
+			continue
+		}
+
+		info, err := ent.Info()
+		if err != nil {
+			return nil, err
+		}
+
 		reqPath := path.Join(requestPath, ent.Name())
 		linkName := ent.Name()
 
@@ -208,7 +232,7 @@ func newDirListing(requestPath, dirPath string) (*directoryListing, error) {
 		dlEnt := &directoryListingEntry{
 			RequestPath: reqPath,
 			LinkName:    linkName,
-			FileInfo:    ent,
+			FileInfo:    info,
 		}
 
 		dlEntries = append(dlEntries, dlEnt)
@@ -216,7 +240,7 @@ func newDirListing(requestPath, dirPath string) (*directoryListing, error) {
 
 	dl := &directoryListing{
 		RequestPath: requestPath,
-		FullPath:    dirPath,
+		FullPath:    path.Join(w.WwwRoot, name),
 		Entries:     dlEntries,
 	}
 	return dl, nil
@@ -1,22 +1,50 @@
 package aspen
 
 import (
+	"bytes"
+	"crypto/sha1"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"io/fs"
+	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
 )
 
 var (
 	InvalidTreeWalkerRoot = errors.New("Invalid tree walker root given")
+
+	// SimplateExtensions lists the file extensions that may hold simplates.
+	// Files with other extensions are always static, and files without an
+	// extension may be negotiated simplates.
+	SimplateExtensions = []string{
+		".atom", ".css", ".csv", ".htm", ".html", ".js", ".json",
+		".markdown", ".md", ".rss", ".svg", ".txt", ".xhtml", ".xml",
+	}
 )
 
 type treeWalker struct {
 	PackageName string
-	Root        string
+	// where the www root was found, used to name simplate files
+	Root string
+	// the www root itself, which is walked and read
+	FS fs.FS
+	// glob patterns of paths, relative to Root, that are always static;
+	// patterns without a "/" match the file's base name
+	StaticPaths []string
+	// number of files parsed at once; DefaultJobs when less than 1
+	Jobs int
+	// library directory, relative to Root, which is never walked
+	LibDir string
+
+	ignore *ignoreMatcher
 }
 
+// newTreeWalker makes a walker for the www root at rootDir, which may be a
+// directory or an archive of one.
 func newTreeWalker(packageName, rootDir string) (*treeWalker, error) {
 	if len(packageName) == 0 {
 		return nil, fmt.Errorf("Package name must be non-empty!")
@@ -27,58 +55,221 @@ func newTreeWalker(packageName, rootDir string) (*treeWalker, error) {
 		return nil, err
 	}
 
-	if !fi.IsDir() {
+	if !fi.IsDir() && !isArchive(rootDir) {
 		return nil, InvalidTreeWalkerRoot
 	}
 
+	fsys, err := OpenWwwFS(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return newTreeWalkerFS(packageName, rootDir, fsys)
+}
+
+// newTreeWalkerFS makes a walker for the www root fsys, whose simplates are
+// named as though found at rootDir.
+func newTreeWalkerFS(packageName, rootDir string, fsys fs.FS) (*treeWalker, error) {
+	if len(packageName) == 0 {
+		return nil, fmt.Errorf("Package name must be non-empty!")
+	}
+
+	absRoot, err := filepath.Abs(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	ignore, err := loadIgnoreMatcher(fsys, absRoot)
+	if err != nil {
+		return nil, err
+	}
+
 	tw := &treeWalker{
 		PackageName: packageName,
-		Root:        rootDir,
+		Root:        absRoot,
+		FS:          fsys,
+		LibDir:      DefaultLibDir,
+		ignore:      ignore,
 	}
 
 	return tw, nil
 }
 
-func (me *treeWalker) Simplates() (<-chan *simplate, error) {
-	var topErr error
-	schan := make(chan *simplate)
-
-	go func() {
-		err := filepath.Walk(me.Root,
-			func(path string, info os.FileInfo, err error) error {
-				if err != nil {
-					debugf("Tree walker error: %+v", err)
-					return nil
-				}
+// Simplates walks the tree, returning every simplate that could be made along
+// with a MultiError covering every file that couldn't.  Failures don't stop
+// the walk, so that all broken simplates are reported in one go.  Files are
+// parsed by up to Jobs goroutines, but simplates and errors are always
+// returned in walk order.
+func (me *treeWalker) Simplates() ([]*simplate, error) {
+	names := []string{}
+	errs := MultiError{}
 
-				debugf("Tree walker checking path at %q", info.Name())
+	err := fs.WalkDir(me.FS, ".",
+		func(name string, ent fs.DirEntry, err error) error {
+			if err != nil {
+				debugf("Tree walker error: %+v", err)
+				errs = append(errs, err)
+				return nil
+			}
 
-				if info.IsDir() {
-					return nil
-				}
+			debugf("Tree walker checking path at %q", name)
 
-				content, err := ioutil.ReadFile(path)
-				if err != nil {
-					return err
+			if isLibDir(me.LibDir, name) || me.ignore.Ignored(name, ent.IsDir()) {
+				debugf("Tree walker ignoring %q", name)
+				if ent.IsDir() {
+					return fs.SkipDir
 				}
+				return nil
+			}
 
-				smplt, err := newSimplateFromString(me.PackageName,
-					me.Root, path, string(content))
-				if err != nil {
-					return err
-				}
-				schan <- smplt
+			if ent.IsDir() {
 				return nil
-			})
+			}
+
+			names = append(names, name)
+			return nil
+		})
 
+	if err != nil {
+		debugf("Tree walker error: %+v", err)
+		errs = append(errs, err)
+	}
+
+	made := make([]*simplate, len(names))
+	errs = append(errs, runJobs(me.Jobs, len(names), func(i int) error {
+		smplt, err := me.newSimplate(names[i])
 		if err != nil {
-			debugf("Tree walker error: %+v", err)
-			schan <- nil
-			*(&topErr) = err
+			debugf("Tree walker simplate error: %+v", err)
+			return err
+		}
+
+		made[i] = smplt
+		return nil
+	})...)
+
+	simplates := []*simplate{}
+	for _, smplt := range made {
+		if smplt != nil {
+			simplates = append(simplates, smplt)
 		}
+	}
+
+	if len(errs) > 0 {
+		return simplates, errs
+	}
+
+	return simplates, nil
+}
+
+// newSimplate reads the file at name within the tree as a simplate, unless it
+// can't be one, in which case a static simplate is made without parsing it.
+func (me *treeWalker) newSimplate(name string) (*simplate, error) {
+	filePath := filepath.Join(me.Root, filepath.FromSlash(name))
+
+	static, err := me.isStaticPath(name)
+	if err != nil {
+		return nil, err
+	}
 
-		close(schan)
-	}()
+	if static {
+		debugf("Tree walker treating %q as static", filePath)
+		smplt, err := newStaticSimplate(me.PackageName, me.Root, filePath)
+		if err != nil {
+			return nil, err
+		}
+
+		// static files may be large, so they're hashed without reading them
+		// into memory
+		smplt.Hash, err = me.fileHash(name)
+		if err != nil {
+			return nil, err
+		}
+
+		return smplt, nil
+	}
+
+	content, err := fs.ReadFile(me.FS, name)
+	if err != nil {
+		return nil, err
+	}
+
+	if isBinaryContent(content) {
+		debugf("Tree walker treating binary file %q as static", filePath)
+		smplt, err := newStaticSimplate(me.PackageName, me.Root, filePath)
+		if err != nil {
+			return nil, err
+		}
+
+		smplt.Hash = contentHash(content)
+		return smplt, nil
+	}
+
+	return newSimplateFromString(me.PackageName, me.Root, filePath, string(content))
+}
+
+// fileHash returns the hex SHA-1 of the file at name within the tree.
+func (me *treeWalker) fileHash(name string) (string, error) {
+	f, err := me.FS.Open(name)
+	if err != nil {
+		return "", err
+	}
+
+	defer f.Close()
+
+	h := sha1.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// isStaticPath reports whether name, a slash-separated path within the tree,
+// is always static.
+func (me *treeWalker) isStaticPath(name string) (bool, error) {
+	ext := path.Ext(name)
+	if len(ext) > 0 && !isSimplateExtension(ext) {
+		return true, nil
+	}
+
+	for _, pattern := range me.StaticPaths {
+		pattern = strings.Trim(pattern, "/")
+		baseOnly := !strings.Contains(pattern, "/")
+
+		// a pattern matching a directory covers everything beneath it
+		for candidate := name; candidate != "."; candidate = path.Dir(candidate) {
+			matchName := candidate
+			if baseOnly {
+				matchName = path.Base(candidate)
+			}
+
+			matched, err := path.Match(pattern, matchName)
+			if err != nil || matched {
+				return matched, err
+			}
+		}
+	}
+
+	return false, nil
+}
+
+func isSimplateExtension(ext string) bool {
+	for _, simplateExt := range SimplateExtensions {
+		if strings.EqualFold(ext, simplateExt) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isBinaryContent sniffs file content, so that binary files without a
+// telling extension are never split on the ^L bytes they may contain.
+func isBinaryContent(content []byte) bool {
+	if bytes.IndexByte(content, 0) >= 0 {
+		return true
+	}
 
-	return (<-chan *simplate)(schan), topErr
+	return !strings.HasPrefix(http.DetectContentType(content), "text/")
 }
@@ -0,0 +1,147 @@
+package aspen
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"go/types"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// typeCheckSources parses and type-checks the generated package in-process,
+// reporting every error rather than only the first.  Generated sources carry
+// line directives, so positions within simplate pages are reported against
+// the simplate itself.
+func (me *siteBuilder) typeCheckSources(sources []string) error {
+	debugf("Site builder type-checking sources")
+	fset := token.NewFileSet()
+	errs := MultiError{}
+	files := []*ast.File{}
+
+	for _, source := range sources {
+		f, err := parser.ParseFile(fset, source, nil, parser.AllErrors)
+		if list, ok := err.(scanner.ErrorList); ok {
+			for _, e := range list {
+				errs = append(errs, me.sourceError(e.Pos, SimplateErrorGoSyntax, e.Msg))
+			}
+			continue
+		}
+
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		files = append(files, f)
+	}
+
+	// type errors in a package that doesn't parse are mostly noise
+	if len(errs) > 0 {
+		return errs
+	}
+
+	imp, err := me.exportImporter(fset, files)
+	if err != nil {
+		return err
+	}
+
+	cfg := &types.Config{
+		Importer: imp,
+		Error: func(err error) {
+			if terr, ok := err.(types.Error); ok {
+				errs = append(errs, me.sourceError(terr.Fset.Position(terr.Pos),
+					SimplateErrorGoType, terr.Msg))
+				return
+			}
+
+			errs = append(errs, err)
+		},
+	}
+
+	cfg.Check(me.GenPackage, fset, files, nil)
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+// exportImporter imports the packages that the generated sources import from
+// export data listed by the go tool, so that they resolve in the environment
+// of the compile step, e.g. from OutputGopath or with modules disabled.
+func (me *siteBuilder) exportImporter(fset *token.FileSet, files []*ast.File) (types.Importer, error) {
+	args := []string{"list", "-e", "-export", "-f", "{{.ImportPath}}\t{{.Export}}"}
+	if me.ModuleMode {
+		args = append(args, "-mod=mod")
+	}
+
+	seen := map[string]bool{}
+	for _, f := range files {
+		for _, spec := range f.Imports {
+			importPath, err := strconv.Unquote(spec.Path.Value)
+			if err != nil || importPath == "C" || importPath == "unsafe" || seen[importPath] {
+				continue
+			}
+
+			seen[importPath] = true
+			args = append(args, importPath)
+		}
+	}
+
+	exports := map[string]string{}
+	if len(seen) > 0 {
+		cmd := me.goCommand(args...)
+		cmd.Stdout = nil
+		out, err := cmd.Output()
+		// packages that fail to build are listed without export data, and
+		// reported as import errors against the simplates importing them
+		if _, ok := err.(*exec.ExitError); err != nil && (!ok || len(out) == 0) {
+			return nil, err
+		}
+
+		lines := bufio.NewScanner(bytes.NewReader(out))
+		for lines.Scan() {
+			parts := strings.SplitN(lines.Text(), "\t", 2)
+			if len(parts) != 2 || len(parts[1]) == 0 {
+				continue
+			}
+
+			exports[parts[0]] = parts[1]
+			if i := strings.LastIndex(parts[0], "/vendor/"); i >= 0 {
+				vendored := parts[0][i+len("/vendor/"):]
+				if _, ok := exports[vendored]; !ok {
+					exports[vendored] = parts[1]
+				}
+			}
+		}
+	}
+
+	return importer.ForCompiler(fset, "gc", func(importPath string) (io.ReadCloser, error) {
+		export, ok := exports[importPath]
+		if !ok {
+			return nil, fmt.Errorf("can't find export data for %q", importPath)
+		}
+
+		return os.Open(export)
+	}), nil
+}
+
+func (me *siteBuilder) sourceError(pos token.Position, code, msg string) *SimplateError {
+	page := -1
+	if simplate, ok := me.simplates[pos.Filename]; ok {
+		page = simplate.pageIndexAt(pos.Line)
+		msg = simplate.unisolate(msg)
+	}
+
+	return newSimplateError(pos.Filename, page, pos.Line, pos.Column, code, "%s", msg)
+}
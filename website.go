@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"mime"
 	"net/http"
@@ -50,7 +51,15 @@ type Website struct {
 	ListDirs           bool
 	Debug              bool
 
+	// static files are served from StaticFS if set, else from WwwRoot, which
+	// may be a directory or an archive of one
+	StaticFS fs.FS `json:"-"`
+	// the www root's library of shared Go sources, never served;
+	// DefaultLibDir if empty
+	LibDir string
+
 	configured bool
+	ignore     *ignoreMatcher
 
 	s  *serverContext
 	ph *websitePipelineHandler
@@ -401,6 +410,16 @@ func (me *Website) Configure(serverBind, wwwRoot, charsetDynamic,
 		charsetDynamic, charsetStatic, indices, debug, listDirs)
 
 	me.WwwRoot = wwwRoot
+	if me.StaticFS == nil && isArchive(wwwRoot) {
+		fsys, err := OpenWwwFS(wwwRoot)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "aspen: CONFIG ERROR: %v\n", err)
+		} else {
+			me.StaticFS = fsys
+		}
+	}
+
+	me.loadIgnoreMatcher()
 	me.CharsetDynamic = charsetDynamic
 	me.CharsetStatic = charsetStatic
 	me.ListDirs = listDirs
@@ -429,6 +448,55 @@ func (me *Website) Configure(serverBind, wwwRoot, charsetDynamic,
 	me.configured = true
 }
 
+func (me *Website) loadIgnoreMatcher() {
+	ignore, err := loadIgnoreMatcher(me.staticFS(), me.WwwRoot)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "aspen: CONFIG ERROR: %v\n", err)
+		ignore, _ = newIgnoreMatcher(IgnoreFilename, nil)
+	}
+
+	me.ignore = ignore
+}
+
+// isIgnored reports whether the file at name, a slash-separated path relative
+// to the www root, is excluded from the site by the www root's .aspenignore or
+// the default ignore patterns, or is within the library directory.
+func (me *Website) isIgnored(name string, isDir bool) bool {
+	if me.ignore == nil {
+		me.loadIgnoreMatcher()
+	}
+
+	libDir := me.LibDir
+	if len(libDir) == 0 {
+		libDir = DefaultLibDir
+	}
+
+	return isLibDir(libDir, name) || me.ignore.Ignored(name, isDir)
+}
+
+// SetLibDir sets the library directory of the www root, whose Go sources are
+// built into the generated package, and which is therefore never served.
+func (me *Website) SetLibDir(libDir string) {
+	me.LibDir = libDir
+}
+
+// SetStaticFS makes the website serve static files and directory listings
+// from fsys, e.g. files embedded in the generated package or an archive of
+// the www root, rather than from the www root on disk.  Passing nil reverts
+// to the www root on disk.
+func (me *Website) SetStaticFS(fsys fs.FS) {
+	me.StaticFS = fsys
+	me.ignore = nil
+}
+
+func (me *Website) staticFS() fs.FS {
+	if me.StaticFS != nil {
+		return me.StaticFS
+	}
+
+	return os.DirFS(me.WwwRoot)
+}
+
 func (me *websitePipelineHandler) NextHandler() pipelineHandler {
 	return me.nh
 }